@@ -10,6 +10,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/Dabz/ccloudexporter/cmd/internal/collector"
 	"github.com/prometheus/client_golang/prometheus"
@@ -18,15 +19,30 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		backfill()
+		return
+	}
+
 	collector.ParseOption()
 	log.WithFields(log.Fields{
 		"Configuration": fmt.Sprintf("%+v", collector.Context),
 	}).Info("ccloudexporter is starting")
 
+	if collector.Context.Once {
+		err := collector.RunOnce()
+		if err != nil {
+			log.WithError(err).Fatalln("Not all metrics have been collected and pushed")
+		}
+		return
+	}
+
 	ccollector := collector.NewCCloudCollector()
 	prometheus.MustRegister(ccollector)
+	ccollector.WatchConfiguration()
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/-/reload", ccollector.ReloadHandler)
 	http.HandleFunc("/health", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusOK)
 	})
@@ -39,3 +55,18 @@ func main() {
 		panic(err)
 	}
 }
+
+// backfill writes the metrics of a range of time in an OpenMetrics file
+func backfill() {
+	options := collector.ParseBackfillOption(os.Args[2:])
+	log.WithFields(log.Fields{
+		"Configuration": fmt.Sprintf("%+v", collector.Context),
+		"From":          options.From,
+		"To":            options.To,
+	}).Info("ccloudexporter is backfilling")
+
+	err := collector.Backfill(options)
+	if err != nil {
+		log.WithError(err).Fatalln("Backfill did not complete, run the same command again to resume it")
+	}
+}
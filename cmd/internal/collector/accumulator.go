@@ -0,0 +1,78 @@
+package collector
+
+//
+// accumulator.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeltaAccumulator keeps the running total of delta metrics, per series
+// The Metrics API returns, for counters, the delta over each interval. Summing these deltas
+// gives a monotonic counter, reset when the exporter restarts
+type DeltaAccumulator struct {
+	mutex  sync.Mutex
+	series map[string]*accumulatedSeries
+}
+
+type accumulatedSeries struct {
+	total         float64
+	lastTimestamp time.Time
+}
+
+// deltaAccumulator is the accumulator shared by all collectors
+var deltaAccumulator = NewDeltaAccumulator()
+
+// NewDeltaAccumulator returns an empty accumulator
+func NewDeltaAccumulator() *DeltaAccumulator {
+	return &DeltaAccumulator{series: make(map[string]*accumulatedSeries)}
+}
+
+// Add adds the delta of an interval to the running total of a series and returns the new total
+// Intervals at or before the last accumulated interval are ignored, thus fetching the same interval twice
+// does not count it twice
+func (accumulator *DeltaAccumulator) Add(desc *prometheus.Desc, labels []string, timestamp time.Time, delta float64) float64 {
+	key := desc.String() + "\xff" + strings.Join(labels, "\xff")
+
+	accumulator.mutex.Lock()
+	defer accumulator.mutex.Unlock()
+	series, present := accumulator.series[key]
+	if !present {
+		series = &accumulatedSeries{}
+		accumulator.series[key] = series
+	}
+
+	if !timestamp.After(series.lastTimestamp) {
+		log.WithFields(log.Fields{"desc": desc.String(), "timestamp": timestamp}).Traceln("Interval has already been accumulated, ignoring it")
+		return series.total
+	}
+	series.total += delta
+	series.lastTimestamp = timestamp
+	return series.total
+}
+
+// IsDeltaMetric returns true if the Metrics API returns the delta of the metric over each interval
+func IsDeltaMetric(metric MetricDescription) bool {
+	if metric.Type != "" {
+		return strings.HasPrefix(metric.Type, "COUNTER")
+	}
+	return strings.HasPrefix(strings.ToLower(metric.Description), "the delta")
+}
+
+// newCounterDesc returns the description of the counter accumulating a delta metric,
+// or nil if the metric is not accumulated
+func newCounterDesc(metric MetricDescription, name string, labels []string) *prometheus.Desc {
+	if !Context.AccumulateDeltas || !IsDeltaMetric(metric) {
+		return nil
+	}
+	return prometheus.NewDesc(name+"_total", metric.Description+" (running total since the exporter started)", labels, nil)
+}
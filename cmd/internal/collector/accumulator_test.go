@@ -0,0 +1,89 @@
+package collector
+
+//
+// accumulator_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAccumulatorIsIdempotent(t *testing.T) {
+	accumulator := NewDeltaAccumulator()
+	desc := prometheus.NewDesc("ccloud_metric_received_bytes_total", "help", []string{"topic"}, nil)
+	first := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.Add(time.Minute)
+
+	accumulator.Add(desc, []string{"orders"}, first, 10)
+	accumulator.Add(desc, []string{"orders"}, second, 5)
+	// The same interval fetched twice must not be counted twice
+	total := accumulator.Add(desc, []string{"orders"}, second, 5)
+	if total != 15 {
+		t.Errorf("Expected a total of 15, got %f", total)
+		t.Fail()
+	}
+
+	// Series are accumulated independently
+	total = accumulator.Add(desc, []string{"payments"}, second, 3)
+	if total != 3 {
+		t.Errorf("Expected a total of 3 for another label set, got %f", total)
+		t.Fail()
+	}
+}
+
+func TestBatchWithCounter(t *testing.T) {
+	Context = ExporterContext{AccumulateDeltas: true}
+	deltaAccumulator = NewDeltaAccumulator()
+	metric := MetricDescription{Name: "io.confluent.kafka.server/received_bytes", Type: "COUNTER_INT64"}
+	ccmetric := CCloudCollectorMetric{
+		metric:      metric,
+		desc:        prometheus.NewDesc("ccloud_metric_received_bytes", "help", []string{"topic"}, nil),
+		counterDesc: newCounterDesc(metric, "ccloud_metric_received_bytes", []string{"topic"}),
+	}
+	if ccmetric.counterDesc == nil {
+		t.Errorf("Expected a counter to be created for a delta metric")
+		t.Fail()
+		return
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := NewDatapointBatch(context.Background(), ccmetric, Rule{})
+	batch.Add([]string{"orders"}, 10, timestamp)
+	batch.Send(ch)
+	batch = NewDatapointBatch(context.Background(), ccmetric, Rule{})
+	batch.Add([]string{"orders"}, 5, timestamp.Add(time.Minute))
+	batch.Send(ch)
+	close(ch)
+
+	var lastCounter float64
+	gauges := 0
+	for m := range ch {
+		result := dto.Metric{}
+		m.Write(&result)
+		if m.Desc() == ccmetric.counterDesc {
+			lastCounter = result.GetCounter().GetValue()
+		} else {
+			gauges++
+		}
+	}
+
+	if gauges != 2 || lastCounter != 15 {
+		t.Errorf("Expected 2 gauges and a counter of 15, got %d gauges and %f", gauges, lastCounter)
+		t.Fail()
+	}
+
+	gauge := MetricDescription{Name: "io.confluent.kafka.server/retained_bytes", Type: "GAUGE_INT64"}
+	if newCounterDesc(gauge, "ccloud_metric_retained_bytes", nil) != nil {
+		t.Errorf("Gauges should not be accumulated")
+		t.Fail()
+	}
+}
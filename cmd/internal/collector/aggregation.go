@@ -0,0 +1,109 @@
+package collector
+
+//
+// aggregation.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// supportedAggregations are the aggregation functions of the Metrics API that can be set on a metric of a rule
+var supportedAggregations = []string{"SUM", "MIN", "MAX"}
+
+// errUnsupportedAggregation is returned by the discovery when the rules are not valid for the described metrics,
+// retrying the discovery would not fix the configuration
+var errUnsupportedAggregation = errors.New("invalid rules")
+
+// describedMetrics are the metrics returned by the descriptor endpoints during the last discovery,
+// thus the aggregations of reloaded rules are validated before the rules are applied
+var (
+	describedMetricsMutex sync.RWMutex
+	describedMetrics      map[string]MetricDescription
+)
+
+// GetAggregationSuffix returns the suffix added to the name of a metric collected with an aggregation
+// e.g. ccloud_metric_retained_bytes_max for MAX. The default aggregation does not add any suffix,
+// thus existing metric names are kept
+func GetAggregationSuffix(aggregation string) string {
+	if aggregation == "" {
+		return ""
+	}
+	return "_" + strings.ToLower(aggregation)
+}
+
+// GetAggregatedMetricKey returns the key of a metric collected with an aggregation in the collectors
+func GetAggregatedMetricKey(metric string, aggregation string) string {
+	if aggregation == "" {
+		return metric
+	}
+	return metric + ":" + aggregation
+}
+
+// SupportsAggregation returns true if the aggregation can be applied to the metric, according to the type of its descriptor
+// SUM is supported by all metrics, MIN and MAX only by gauges, e.g. GAUGE_INT64
+func SupportsAggregation(metric MetricDescription, aggregation string) bool {
+	if aggregation == "" || aggregation == "SUM" {
+		return true
+	}
+	return strings.HasPrefix(metric.Type, "GAUGE_")
+}
+
+// setDescribedMetrics records the metrics returned by the descriptor endpoints
+func setDescribedMetrics(descriptors map[string]MetricDescription) {
+	describedMetricsMutex.Lock()
+	defer describedMetricsMutex.Unlock()
+	describedMetrics = descriptors
+}
+
+// getDescribedMetrics returns the metrics returned by the descriptor endpoints, nil before the first discovery
+func getDescribedMetrics() map[string]MetricDescription {
+	describedMetricsMutex.RLock()
+	defer describedMetricsMutex.RUnlock()
+	return describedMetrics
+}
+
+// checkAggregations returns an error if an aggregation of the rule is invalid, or not supported by the descriptor of the metric
+// Metrics without descriptor, e.g. before the first discovery, are validated once the descriptors have been fetched
+func (rule Rule) checkAggregations(descriptors map[string]MetricDescription) error {
+	metrics := make([]string, 0, len(rule.Aggregations))
+	for metric := range rule.Aggregations {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		aggregation := rule.Aggregations[metric]
+		if !contains(supportedAggregations, aggregation) {
+			return fmt.Errorf("aggregation %s of %s is invalid, supported aggregations are %s", aggregation, metric, supportedAggregations)
+		}
+
+		if !contains(rule.Metrics, metric) {
+			return fmt.Errorf("an aggregation is defined for %s, which is not in the metrics of the rule", metric)
+		}
+
+		descriptor, present := descriptors[metric]
+		if present && !SupportsAggregation(descriptor, aggregation) {
+			return fmt.Errorf("aggregation %s is not supported by %s, a metric of type %s", aggregation, metric, descriptor.Type)
+		}
+	}
+	return nil
+}
+
+// checkRulesAggregations returns an error wrapping errUnsupportedAggregation if an aggregation of the rules
+// is not supported by the descriptors
+func checkRulesAggregations(rules []Rule, descriptors map[string]MetricDescription) error {
+	for _, rule := range rules {
+		if err := rule.checkAggregations(descriptors); err != nil {
+			return fmt.Errorf("%w: %s", errUnsupportedAggregation, err)
+		}
+	}
+	return nil
+}
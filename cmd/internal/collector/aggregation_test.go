@@ -0,0 +1,146 @@
+package collector
+
+//
+// aggregation_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKafkaCollectorWithAggregations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[
+			{"name":"io.confluent.kafka.server/retained_bytes","type":"GAUGE_INT64","labels":[{"key":"topic"}]},
+			{"name":"io.confluent.kafka.server/received_bytes","type":"COUNTER_INT64","labels":[{"key":"topic"}]}
+		]}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	metrics := []string{"io.confluent.kafka.server/retained_bytes", "io.confluent.kafka.server/received_bytes"}
+	Context = ExporterContext{
+		HTTPBaseURL: server.URL + "/",
+		Retry:       RetryPolicy{MaxAttempts: 1},
+		Rules: []Rule{
+			{id: 0, Clusters: []string{"lkc-1"}, Metrics: metrics},
+			{id: 1, Clusters: []string{"lkc-1"}, Metrics: metrics, Aggregations: map[string]string{"io.confluent.kafka.server/retained_bytes": "MAX"}},
+		},
+	}
+
+	resource := ResourceDescription{Type: "kafka", Labels: []MetricLabel{{Key: "kafka.id"}}}
+	collector, err := NewKafkaCCloudCollector(context.Background(), nil, resource)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	maxMetric, present := collector.metrics[GetAggregatedMetricKey("io.confluent.kafka.server/retained_bytes", "MAX")]
+	if !present || !strings.Contains(maxMetric.desc.String(), `"ccloud_metric_retained_bytes_max"`) {
+		t.Errorf("Expected the MAX aggregation of retained_bytes to be collected with a suffix")
+		t.Fail()
+	}
+
+	defaultMetric, present := collector.metrics["io.confluent.kafka.server/retained_bytes"]
+	if !present || !strings.Contains(defaultMetric.desc.String(), `"ccloud_metric_retained_bytes"`) {
+		t.Errorf("Expected the default aggregation of retained_bytes to keep its name")
+		t.Fail()
+	}
+
+	// Other metrics of the rule are collected with their default aggregation
+	if _, present := collector.metrics[GetAggregatedMetricKey("io.confluent.kafka.server/received_bytes", "MAX")]; present {
+		t.Errorf("MAX should only be applied to retained_bytes")
+		t.Fail()
+	}
+	if _, present := collector.metrics["io.confluent.kafka.server/received_bytes"]; !present {
+		t.Errorf("Expected received_bytes to be collected with the default aggregation")
+		t.Fail()
+	}
+}
+
+func TestInvalidAggregation(t *testing.T) {
+	rules := []Rule{{Clusters: []string{"lkc-1"}, Metrics: []string{"metric"}, GroupByLabels: []string{"kafka.id"}, Aggregations: map[string]string{"metric": "AVG"}}}
+	if checkRules(rules) == nil {
+		t.Errorf("Expected AVG to be rejected")
+		t.Fail()
+	}
+
+	rules[0].Aggregations = map[string]string{"other": "MAX"}
+	if checkRules(rules) == nil {
+		t.Errorf("Expected an aggregation of a metric that is not collected by the rule to be rejected")
+		t.Fail()
+	}
+}
+
+func TestAggregationSupportedByDescriptor(t *testing.T) {
+	descriptors := map[string]MetricDescription{
+		"io.confluent.kafka.server/retained_bytes": {Name: "io.confluent.kafka.server/retained_bytes", Type: "GAUGE_INT64"},
+		"io.confluent.kafka.server/received_bytes": {Name: "io.confluent.kafka.server/received_bytes", Type: "COUNTER_INT64"},
+	}
+	metrics := []string{"io.confluent.kafka.server/retained_bytes", "io.confluent.kafka.server/received_bytes"}
+	rule := Rule{Metrics: metrics, Aggregations: map[string]string{"io.confluent.kafka.server/retained_bytes": "MAX", "io.confluent.kafka.server/received_bytes": "SUM"}}
+	if err := rule.checkAggregations(descriptors); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+	}
+
+	rule.Aggregations["io.confluent.kafka.server/received_bytes"] = "MAX"
+	if rule.checkAggregations(descriptors) == nil {
+		t.Errorf("MAX should not be supported for a counter")
+		t.Fail()
+	}
+	// Before the first discovery, the type of the metrics is unknown
+	if err := rule.checkAggregations(nil); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+	}
+}
+
+func TestDiscoverRejectsUnsupportedAggregation(t *testing.T) {
+	available := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !available:
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasSuffix(r.URL.Path, descriptorResourceURI):
+			fmt.Fprint(w, `{"data":[{"type":"kafka","labels":[{"key":"kafka.id"}]}]}`)
+		default:
+			fmt.Fprint(w, `{"data":[{"name":"io.confluent.kafka.server/received_bytes","type":"COUNTER_INT64","description":"The delta count of bytes received","labels":[{"key":"topic"}]}]}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", Granularity: "PT1M", Mode: "query", Retry: RetryPolicy{MaxAttempts: 1}, ScrapeTimeout: 10}
+	initHTTPClient()
+	metric := "io.confluent.kafka.server/received_bytes"
+	setConfiguredRules([]Rule{{Clusters: []string{"lkc-1"}, Metrics: []string{metric}, GroupByLabels: []string{"kafka.id"}, Aggregations: map[string]string{metric: "MAX"}}})
+	collector := &CCloudCollector{cache: NewCache(0, false)}
+
+	// MAX is not supported by a counter, retrying the discovery would not fix the rules
+	err := collector.discover()
+	if !errors.Is(err, errUnsupportedAggregation) {
+		t.Errorf("Expected the aggregation to be rejected as a configuration error, got %v", err)
+		t.Fail()
+	}
+
+	available = false
+	err = collector.discover()
+	if err == nil || errors.Is(err, errUnsupportedAggregation) {
+		t.Errorf("Expected an unavailable Metrics API to be retried, got %v", err)
+		t.Fail()
+	}
+}
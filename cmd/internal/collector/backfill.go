@@ -0,0 +1,459 @@
+package collector
+
+//
+// backfill.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// BackfillOptions are the options of the backfill command
+type BackfillOptions struct {
+	From       time.Time
+	To         time.Time
+	Output     string
+	Checkpoint string
+	Chunk      time.Duration
+	// OpenEnded is set when -to is omitted, a resumed backfill then keeps the end recorded in its checkpoint
+	OpenEnded bool
+}
+
+// timeWindow is a range of intervals, the end is excluded
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// backfillCheckpoint records the progress of a backfill, so an interrupted backfill can be resumed
+// The metric families of an OpenMetrics file can not be interleaved, thus the samples are appended to
+// one part file per family, and the output file is assembled once all intervals have been fetched.
+// Families contains the size of each part file once all intervals before Next have been written
+type backfillCheckpoint struct {
+	From     time.Time                  `json:"from"`
+	To       time.Time                  `json:"to"`
+	Next     time.Time                  `json:"next"`
+	Families map[string]*backfillFamily `json:"families"`
+}
+
+type backfillFamily struct {
+	Help string `json:"help"`
+	Size int64  `json:"size"`
+}
+
+// defaultBackfillChunks is the range of intervals queried at once for each granularity,
+// it keeps the number of data points returned by a query within a few pages
+var defaultBackfillChunks = map[string]time.Duration{
+	"PT1M":  time.Hour,
+	"PT5M":  6 * time.Hour,
+	"PT15M": 12 * time.Hour,
+	"PT30M": 24 * time.Hour,
+	"PT1H":  24 * time.Hour,
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// ParseBackfillOption parses the options of the backfill command and the configuration file
+// This function will exit if the options are invalid
+func ParseBackfillOption(args []string) BackfillOptions {
+	var from string
+	var to string
+	options := BackfillOptions{}
+
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	flags.StringVar(&from, "from", "", "Start of the range to backfill, in RFC3339 format, e.g. 2021-01-01T00:00:00Z")
+	flags.StringVar(&to, "to", "", "End of the range to backfill, in RFC3339 format. By default, now minus the delay")
+	flags.StringVar(&options.Output, "output", "ccloudexporter.om", "Path of the OpenMetrics file to write")
+	flags.StringVar(&options.Checkpoint, "checkpoint", "", "Path of the file recording the progress of the backfill, used to resume it. By default, the output path with the .checkpoint suffix")
+	flags.DurationVar(&options.Chunk, "chunk", 0, "Range of intervals fetched by a single query, e.g. 1h. By default, depends on the granularity")
+	parseOptions(flags, args)
+
+	var err error
+	options.From, err = time.Parse(time.RFC3339, from)
+	if err != nil {
+		log.WithError(err).Fatalln("-from is required and must be a date in RFC3339 format")
+	}
+
+	options.To = time.Now().Add(time.Duration(-Context.Delay) * time.Second)
+	options.OpenEnded = to == ""
+	if to != "" {
+		options.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			log.WithError(err).Fatalln("-to must be a date in RFC3339 format")
+		}
+	}
+
+	if options.Checkpoint == "" {
+		options.Checkpoint = options.Output + ".checkpoint"
+	}
+	if options.Chunk == 0 {
+		options.Chunk = defaultBackfillChunks[Context.Granularity]
+	}
+
+	err = checkBackfillOptions(options)
+	if err != nil {
+		log.WithError(err).Fatalln("Invalid backfill options")
+	}
+	return options
+}
+
+// checkBackfillOptions returns an error describing the first invalid option of the backfill command
+func checkBackfillOptions(options BackfillOptions) error {
+	if Context.Mode != "query" {
+		return errors.New("backfilling is only supported by the query mode")
+	}
+
+	if !options.From.Before(options.To) {
+		return errors.New("-from must be before -to")
+	}
+
+	granularity := GetGranularityDuration(Context.Granularity)
+	if options.Chunk <= 0 || options.Chunk%granularity != 0 {
+		return fmt.Errorf("-chunk must be a multiple of the granularity, %s", granularity)
+	}
+
+	if options.Output == "" {
+		return errors.New("-output is required")
+	}
+	return nil
+}
+
+// Backfill fetches the data points of all rules over a range of time and writes them in an OpenMetrics file,
+// that can be imported with promtool tsdb create-blocks-from openmetrics
+// The progress is recorded in a checkpoint file after each chunk, thus running the same backfill again resumes it
+func Backfill(options BackfillOptions) error {
+	// Running totals would restart on every chunk and clash with the gauges of the same name in OpenMetrics,
+	// and samples can not be imported without their timestamp
+	Context.AccumulateDeltas = false
+	Context.NoTimestamp = false
+
+	granularity := GetGranularityDuration(Context.Granularity)
+	from := options.From.Truncate(granularity)
+	to := options.To.Truncate(granularity)
+	partsDir := options.Output + ".parts"
+
+	checkpoint, err := loadBackfillCheckpoint(options.Checkpoint, from, to, options.OpenEnded)
+	if err != nil {
+		return err
+	}
+	to = checkpoint.To
+	err = checkpoint.truncateParts(partsDir)
+	if err != nil {
+		return err
+	}
+
+	initHTTPClient()
+	if isDiscoveryConfigured() {
+		_, err = refreshDiscoveredResources()
+		if err != nil {
+			return fmt.Errorf("can not discover the resources of the organization: %s", err)
+		}
+	}
+	refreshResolvedTopics()
+
+	collector := &CCloudCollector{metrics: make(map[string]CCloudCollectorMetric), cache: NewCache(0, false), store: NewMetricStore()}
+	err = collector.discover()
+	if err != nil {
+		return fmt.Errorf("can not discover the metrics exposed by the Metrics API: %s", err)
+	}
+
+	for start := checkpoint.Next; start.Before(to); start = checkpoint.Next {
+		end := start.Add(options.Chunk)
+		if end.After(to) {
+			end = to
+		}
+
+		families, err := collector.collectWindow(timeWindow{start: start, end: end})
+		if err != nil {
+			return fmt.Errorf("can not backfill %s: %s", formatInterval(start, end), err)
+		}
+		err = checkpoint.appendParts(partsDir, families)
+		if err != nil {
+			return err
+		}
+		checkpoint.Next = end
+		err = checkpoint.save(options.Checkpoint)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"interval": formatInterval(start, end), "families": len(families)}).Infoln("Intervals have been backfilled")
+	}
+
+	err = checkpoint.assemble(partsDir, options.Output)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(partsDir)
+	os.Remove(options.Checkpoint)
+	log.WithField("output", options.Output).Infoln("Backfill has completed")
+	return nil
+}
+
+// collectWindow collects the data points of all rules over a range of intervals, grouped by metric family
+// An error is returned if any query did not succeed, as the range would be incomplete
+func (cc *CCloudCollector) collectWindow(window timeWindow) (map[string]*dto.MetricFamily, error) {
+	return cc.collectFamilies(withBackfillWindow(context.Background(), window))
+}
+
+// collectFamilies collects the data points of all rules once, grouped by metric family
+// If any rule did not succeed, the data points collected by the other rules are returned along with an error
+func (cc *CCloudCollector) collectFamilies(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	ccmetrics := cc.metricsByDesc()
+	errs := NewRuleErrors()
+	cc.reportUncollectedMetrics(errs)
+	ch := make(chan prometheus.Metric, 1000)
+	go func() {
+		cc.collectWithContext(withRuleErrors(ctx, errs), ch)
+		close(ch)
+	}()
+
+	families := make(map[string]*dto.MetricFamily)
+	var writeErr error
+	for metric := range ch {
+		// The latency of the requests is not backfilled
+		ccmetric, present := ccmetrics[metric.Desc()]
+		if !present {
+			continue
+		}
+
+		sample := &dto.Metric{}
+		err := metric.Write(sample)
+		if err != nil {
+			writeErr = err
+			continue
+		}
+		family, present := families[ccmetric.name]
+		if !present {
+			name := ccmetric.name
+			help := ccmetric.metric.Description
+			family = &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_GAUGE.Enum()}
+			families[name] = family
+		}
+		family.Metric = append(family.Metric, sample)
+	}
+
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return families, errs.Err()
+}
+
+// reportUncollectedMetrics records an error for each metric of a rule that no collector handles,
+// e.g. a metric that is not exposed by the Metrics API or a resource type without descriptor
+func (cc *CCloudCollector) reportUncollectedMetrics(errs *RuleErrors) {
+	cc.mutex.RLock()
+	defer cc.mutex.RUnlock()
+
+	for _, rule := range cc.rules {
+		for _, metric := range rule.Metrics {
+			key := GetAggregatedMetricKey(metric, rule.GetAggregation(metric))
+			collected := false
+			if cc.kafkaCollector != nil && containsRule(cc.kafkaCollector.rules, rule.id) {
+				_, collected = cc.kafkaCollector.metrics[key]
+			}
+			for _, resourceCollector := range cc.resourceCollectors {
+				if _, present := resourceCollector.metrics[key]; present && containsRule(resourceCollector.rules, rule.id) {
+					collected = true
+				}
+			}
+			if !collected {
+				errs.Add(rule.id, fmt.Errorf("%s is not collected, it is not exposed by the Metrics API for the resources of the rule", metric))
+			}
+		}
+	}
+}
+
+// metricsByDesc returns the metrics collected from the Metrics API, by Prometheus description
+func (cc *CCloudCollector) metricsByDesc() map[*prometheus.Desc]CCloudCollectorMetric {
+	cc.mutex.RLock()
+	defer cc.mutex.RUnlock()
+
+	ccmetrics := make(map[*prometheus.Desc]CCloudCollectorMetric)
+	if cc.kafkaCollector != nil {
+		for _, ccmetric := range cc.kafkaCollector.metrics {
+			ccmetrics[ccmetric.desc] = ccmetric
+		}
+	}
+	for _, resourceCollector := range cc.resourceCollectors {
+		for _, ccmetric := range resourceCollector.metrics {
+			ccmetrics[ccmetric.desc] = ccmetric
+		}
+	}
+	return ccmetrics
+}
+
+// loadBackfillCheckpoint reads the checkpoint of a previous backfill of the same range,
+// or returns a new checkpoint if there is none
+// If openEnded is set, the end of the range is taken from the checkpoint, as now minus the delay moves between runs
+func loadBackfillCheckpoint(path string, from time.Time, to time.Time, openEnded bool) (*backfillCheckpoint, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &backfillCheckpoint{From: from, To: to, Next: from, Families: make(map[string]*backfillFamily)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &backfillCheckpoint{}
+	err = json.Unmarshal(content, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("can not parse the checkpoint %s: %s", path, err)
+	}
+	if !checkpoint.From.Equal(from) || (!openEnded && !checkpoint.To.Equal(to)) {
+		return nil, fmt.Errorf("the checkpoint %s has been created for another range (%s), remove it to start a new backfill", path, formatInterval(checkpoint.From, checkpoint.To))
+	}
+	if checkpoint.Families == nil {
+		checkpoint.Families = make(map[string]*backfillFamily)
+	}
+	log.WithFields(log.Fields{"checkpoint": path, "next": checkpoint.Next, "to": checkpoint.To}).Infoln("Resuming the backfill from the checkpoint")
+	return checkpoint, nil
+}
+
+// truncateParts removes the samples written to the part files after the checkpoint was saved,
+// e.g. by a backfill interrupted while writing a chunk
+func (checkpoint *backfillCheckpoint) truncateParts(partsDir string) error {
+	err := os.MkdirAll(partsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(partsDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(partsDir, file.Name())
+		family, present := checkpoint.Families[file.Name()]
+		if !present {
+			err = os.Remove(path)
+		} else if file.Size() > family.Size {
+			err = os.Truncate(path, family.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, family := range checkpoint.Families {
+		info, err := os.Stat(filepath.Join(partsDir, name))
+		if err != nil || info.Size() < family.Size {
+			return fmt.Errorf("the part file of %s is missing or incomplete, remove the checkpoint to start a new backfill", name)
+		}
+	}
+	return nil
+}
+
+// appendParts appends the samples of each metric family to its part file
+func (checkpoint *backfillCheckpoint) appendParts(partsDir string, families map[string]*dto.MetricFamily) error {
+	for name, family := range families {
+		var buffer bytes.Buffer
+		_, err := expfmt.MetricFamilyToOpenMetrics(&buffer, family)
+		if err != nil {
+			return err
+		}
+
+		// The metadata of a family is written once, while assembling the output file
+		samples := make([]string, 0, len(family.Metric))
+		for _, line := range strings.SplitAfter(buffer.String(), "\n") {
+			if line != "" && !strings.HasPrefix(line, "#") {
+				samples = append(samples, line)
+			}
+		}
+		content := strings.Join(samples, "")
+
+		file, err := os.OpenFile(filepath.Join(partsDir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString(content)
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		if _, present := checkpoint.Families[name]; !present {
+			checkpoint.Families[name] = &backfillFamily{Help: family.GetHelp()}
+		}
+		checkpoint.Families[name].Size += int64(len(content))
+	}
+	return nil
+}
+
+// save writes the checkpoint, the previous checkpoint is only replaced once the new one is entirely written
+func (checkpoint *backfillCheckpoint) save(path string) error {
+	content, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// assemble writes the OpenMetrics file, with the samples of each family written contiguously
+func (checkpoint *backfillCheckpoint) assemble(partsDir string, output string) error {
+	file, err := os.Create(output + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	names := make([]string, 0, len(checkpoint.Families))
+	for name := range checkpoint.Families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		family := checkpoint.Families[name]
+		if family.Size == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(file, "# HELP %s %s\n# TYPE %s gauge\n", name, helpEscaper.Replace(family.Help), name)
+		if err != nil {
+			return err
+		}
+
+		part, err := os.Open(filepath.Join(partsDir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(file, part, family.Size)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprint(file, "# EOF\n")
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(output+".tmp", output)
+}
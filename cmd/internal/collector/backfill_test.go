@@ -0,0 +1,220 @@
+package collector
+
+//
+// backfill_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBackfillServer serves the descriptors and the queries of a backfill, the queries starting at failAfter fail
+func newBackfillServer(failAfter *time.Time) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, descriptorResourceURI):
+			fmt.Fprint(w, `{"data":[{"type":"kafka","labels":[{"key":"kafka.id"}]}]}`)
+		case strings.HasSuffix(r.URL.Path, descriptorURI):
+			fmt.Fprint(w, `{"data":[{"name":"io.confluent.kafka.server/retained_bytes","type":"GAUGE_INT64","description":"The current count of bytes retained","labels":[{"key":"topic"}]}]}`)
+		default:
+			query := Query{}
+			json.NewDecoder(r.Body).Decode(&query)
+			start, _ := time.Parse(time.RFC3339, strings.Split(query.Intervals[0], "/")[0])
+			if !start.Before(*failAfter) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, `{"data":[
+				{"timestamp":"%s","value":1.0,"metric.topic":"orders"},
+				{"timestamp":"%s","value":2.0,"metric.topic":"orders"}
+			]}`, start.Format(time.RFC3339), start.Add(time.Minute).Format(time.RFC3339))
+		}
+	}))
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{
+		HTTPBaseURL:   server.URL + "/",
+		Retry:         RetryPolicy{MaxAttempts: 1},
+		Granularity:   "PT1M",
+		Mode:          "query",
+		ScrapeTimeout: 10,
+		Rules: []Rule{
+			{id: 0, Clusters: []string{"lkc-1"}, Metrics: []string{"io.confluent.kafka.server/retained_bytes"}, GroupByLabels: []string{"kafka.id", "topic"}},
+		},
+	}
+	setConfiguredRules(Context.Rules)
+	return server
+}
+
+func TestBackfillResumesFromCheckpoint(t *testing.T) {
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	failAfter := from.Add(time.Hour)
+	server := newBackfillServer(&failAfter)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	options := BackfillOptions{
+		From:       from,
+		To:         from.Add(2 * time.Hour),
+		Output:     filepath.Join(dir, "backfill.om"),
+		Checkpoint: filepath.Join(dir, "backfill.checkpoint"),
+		Chunk:      time.Hour,
+	}
+
+	// The second chunk fails, the first one is kept in the checkpoint
+	if Backfill(options) == nil {
+		t.Errorf("Expected the backfill to fail")
+		t.Fail()
+		return
+	}
+	checkpoint, err := loadBackfillCheckpoint(options.Checkpoint, options.From, options.To, false)
+	if err != nil || !checkpoint.Next.Equal(failAfter) {
+		t.Errorf("Expected the checkpoint to record the first chunk, got %v (%v)", checkpoint, err)
+		t.Fail()
+		return
+	}
+
+	failAfter = options.To
+	err = Backfill(options)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	content, err := ioutil.ReadFile(options.Output)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	output := string(content)
+	if strings.Count(output, "# TYPE ccloud_metric_retained_bytes gauge\n") != 1 || strings.Count(output, "ccloud_metric_retained_bytes{") != 4 {
+		t.Errorf("Expected one family with the 4 samples of both chunks, got:\n%s", output)
+		t.Fail()
+	}
+	if !strings.HasSuffix(output, "\n# EOF\n") {
+		t.Errorf("Expected the OpenMetrics file to end with # EOF")
+		t.Fail()
+	}
+	if _, err := os.Stat(options.Checkpoint); !os.IsNotExist(err) {
+		t.Errorf("Expected the checkpoint to be removed once the backfill has completed")
+		t.Fail()
+	}
+}
+
+func TestBackfillResumesWithoutTo(t *testing.T) {
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	failAfter := from.Add(time.Hour)
+	server := newBackfillServer(&failAfter)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	// -to is omitted, the end of the range is now minus the delay
+	options := BackfillOptions{
+		From:       from,
+		To:         from.Add(2 * time.Hour),
+		OpenEnded:  true,
+		Output:     filepath.Join(dir, "backfill.om"),
+		Checkpoint: filepath.Join(dir, "backfill.checkpoint"),
+		Chunk:      time.Hour,
+	}
+	if Backfill(options) == nil {
+		t.Errorf("Expected the backfill to fail")
+		t.Fail()
+		return
+	}
+
+	// Time has passed when the same command is run again, the range of the checkpoint is kept
+	failAfter = from.Add(2 * time.Hour)
+	options.To = from.Add(3 * time.Hour)
+	err = Backfill(options)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	content, err := ioutil.ReadFile(options.Output)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	if strings.Count(string(content), "ccloud_metric_retained_bytes{") != 4 {
+		t.Errorf("Expected the 4 samples of the range of the checkpoint, got:\n%s", content)
+		t.Fail()
+	}
+}
+
+func TestBackfillCheckpointOfAnotherRange(t *testing.T) {
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backfill.checkpoint")
+	checkpoint, _ := loadBackfillCheckpoint(path, from, from.Add(time.Hour), false)
+	err = checkpoint.save(path)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	_, err = loadBackfillCheckpoint(path, from, from.Add(2*time.Hour), false)
+	if err == nil {
+		t.Errorf("Expected an explicit -to to be checked against the checkpoint")
+		t.Fail()
+	}
+	_, err = loadBackfillCheckpoint(path, from.Add(time.Minute), from.Add(time.Hour), true)
+	if err == nil {
+		t.Errorf("Expected -from to be checked against the checkpoint")
+		t.Fail()
+	}
+}
+
+func TestBackfillOptions(t *testing.T) {
+	Context = ExporterContext{Granularity: "PT5M", Mode: "query"}
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	options := BackfillOptions{From: from, To: from.Add(time.Hour), Output: "backfill.om", Chunk: 7 * time.Minute}
+	if checkBackfillOptions(options) == nil {
+		t.Errorf("Expected a chunk that is not a multiple of the granularity to be rejected")
+		t.Fail()
+	}
+
+	options.Chunk = time.Hour
+	options.To = from
+	if checkBackfillOptions(options) == nil {
+		t.Errorf("Expected an empty range to be rejected")
+		t.Fail()
+	}
+}
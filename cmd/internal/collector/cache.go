@@ -17,51 +17,124 @@ import (
 
 // CCloudCollectorCache is used to cache Prometheus metrics
 // The main goal of this cache is to avoid to overload the Metrics API
+// Concurrent scrapes share a single refresh of the cache
 type CCloudCollectorCache struct {
-	cachedValue  []prometheus.Metric
-	cachedTime   time.Time
-	cachedSecond int
+	mutex                sync.Mutex
+	cachedValue          []prometheus.Metric
+	cachedTime           time.Time
+	cachedSecond         int
+	staleWhileRevalidate bool
+	// refreshDone is closed once the refresh in progress completes, nil if no refresh is in progress
+	refreshDone chan struct{}
+	// generation is incremented on invalidation, so a refresh started before is not cached
+	generation int
 }
 
-// MaybeSendToChan populate the chan if required
-// return true if it populates, otherwise false
-func (ccc *CCloudCollectorCache) MaybeSendToChan(ch chan<- prometheus.Metric) bool {
-	now := time.Now()
-	if ccc.cachedTime.Add(time.Second*10).After(now) && len(ccc.cachedValue) > 0 {
+// Collect sends the cached metrics to the chan, refreshing the cache with the refresh function if it has expired
+// Only one refresh runs at a time, other scrapes wait for it to complete or, with
+// staleWhileRevalidate, are served the previous metrics while the refresh runs in the background
+func (ccc *CCloudCollectorCache) Collect(ch chan<- prometheus.Metric, refresh func(chan<- prometheus.Metric)) {
+	ccc.mutex.Lock()
+	if ccc.isFresh() {
+		cachedValue := ccc.cachedValue
+		ccc.mutex.Unlock()
 		log.Trace("Returning cached values")
-		ccc.SendToChan(ch)
-		return true
+		sendToChan(cachedValue, ch)
+		return
 	}
-	return false
+
+	hasStaleValue := ccc.staleWhileRevalidate && !ccc.cachedTime.IsZero()
+	if ccc.refreshDone == nil {
+		done := make(chan struct{})
+		ccc.refreshDone = done
+		generation := ccc.generation
+		if hasStaleValue {
+			cachedValue := ccc.cachedValue
+			ccc.mutex.Unlock()
+			log.Trace("Returning stale cached values while refreshing the cache")
+			go ccc.populate(refresh, nil, generation, done)
+			sendToChan(cachedValue, ch)
+			return
+		}
+
+		ccc.mutex.Unlock()
+		ccc.populate(refresh, ch, generation, done)
+		return
+	}
+
+	done := ccc.refreshDone
+	cachedValue := ccc.cachedValue
+	ccc.mutex.Unlock()
+	if hasStaleValue {
+		log.Trace("Returning stale cached values, the cache is being refreshed")
+		sendToChan(cachedValue, ch)
+		return
+	}
+
+	log.Trace("Waiting for the cache to be refreshed")
+	<-done
+	ccc.mutex.Lock()
+	cachedValue = ccc.cachedValue
+	ccc.mutex.Unlock()
+	sendToChan(cachedValue, ch)
 }
 
-// Hijack all data from the chanel into the cache and forward them to another chan
-func (ccc *CCloudCollectorCache) Hijack(ch chan prometheus.Metric, origCh chan<- prometheus.Metric, wg *sync.WaitGroup) {
+// populate invokes the refresh function and stores its result in the cache
+// Metrics are forwarded to ch while they are collected, if ch is not nil
+func (ccc *CCloudCollectorCache) populate(refresh func(chan<- prometheus.Metric), ch chan<- prometheus.Metric, generation int, done chan struct{}) {
 	log.Trace("Populating cache")
-	ccc.cachedValue = []prometheus.Metric{}
-	ccc.cachedTime = time.Now()
+	collected := []prometheus.Metric{}
+	refreshChan := make(chan prometheus.Metric)
+	var wg sync.WaitGroup
 	wg.Add(1)
-	go func(ch chan prometheus.Metric, origCh chan<- prometheus.Metric) {
-		for metric := range ch {
-			ccc.cachedValue = append(ccc.cachedValue, metric)
-			origCh <- metric
+	go func() {
+		defer wg.Done()
+		for metric := range refreshChan {
+			collected = append(collected, metric)
+			if ch != nil {
+				ch <- metric
+			}
 		}
-		wg.Done()
-	}(ch, origCh)
+	}()
+	refresh(refreshChan)
+	close(refreshChan)
+	wg.Wait()
+
+	ccc.mutex.Lock()
+	if generation == ccc.generation {
+		ccc.cachedValue = collected
+		ccc.cachedTime = time.Now()
+	}
+	ccc.refreshDone = nil
+	ccc.mutex.Unlock()
+	close(done)
+}
+
+// isFresh returns true if the cached metrics have not expired, the mutex must be held
+func (ccc *CCloudCollectorCache) isFresh() bool {
+	return !ccc.cachedTime.IsZero() && ccc.cachedTime.Add(time.Second*time.Duration(ccc.cachedSecond)).After(time.Now())
+}
+
+// Invalidate drops all cached data, e.g. after the rules have been reloaded
+func (ccc *CCloudCollectorCache) Invalidate() {
+	ccc.mutex.Lock()
+	defer ccc.mutex.Unlock()
+	ccc.cachedValue = []prometheus.Metric{}
+	ccc.cachedTime = time.Time{}
+	ccc.generation++
 }
 
-// SendToChan all cached data
-func (ccc *CCloudCollectorCache) SendToChan(ch chan<- prometheus.Metric) {
-	for _, metric := range ccc.cachedValue {
+func sendToChan(metrics []prometheus.Metric, ch chan<- prometheus.Metric) {
+	for _, metric := range metrics {
 		ch <- metric
 	}
 }
 
 // NewCache returns a newly created cache
-func NewCache(duration int) CCloudCollectorCache {
-	ccc := CCloudCollectorCache{}
+func NewCache(duration int, staleWhileRevalidate bool) *CCloudCollectorCache {
+	ccc := &CCloudCollectorCache{}
 	ccc.cachedValue = []prometheus.Metric{}
-	ccc.cachedTime = time.UnixMilli(0)
 	ccc.cachedSecond = duration
+	ccc.staleWhileRevalidate = staleWhileRevalidate
 	return ccc
 }
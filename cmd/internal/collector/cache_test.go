@@ -0,0 +1,111 @@
+package collector
+
+//
+// cache_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheTestDesc = prometheus.NewDesc("ccloud_metric_test", "help", nil, nil)
+
+func countingRefresh(refreshes *int32, delay time.Duration) func(chan<- prometheus.Metric) {
+	return func(ch chan<- prometheus.Metric) {
+		value := atomic.AddInt32(refreshes, 1)
+		time.Sleep(delay)
+		ch <- prometheus.MustNewConstMetric(cacheTestDesc, prometheus.GaugeValue, float64(value))
+	}
+}
+
+func collectFromCache(cache *CCloudCollectorCache, refresh func(chan<- prometheus.Metric)) int {
+	ch := make(chan prometheus.Metric, 10)
+	cache.Collect(ch, refresh)
+	close(ch)
+	return len(ch)
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	var refreshes int32
+	cache := NewCache(60, false)
+	refresh := countingRefresh(&refreshes, time.Millisecond*50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if received := collectFromCache(cache, refresh); received != 1 {
+				t.Errorf("Expected every scrape to receive the metric, got %d", received)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&refreshes) != 1 {
+		t.Errorf("Expected a single refresh for concurrent scrapes, got %d", refreshes)
+		t.Fail()
+	}
+}
+
+func TestCacheHonorsCachedSecond(t *testing.T) {
+	var refreshes int32
+	cache := NewCache(1, false)
+	refresh := countingRefresh(&refreshes, 0)
+
+	collectFromCache(cache, refresh)
+	collectFromCache(cache, refresh)
+	if atomic.LoadInt32(&refreshes) != 1 {
+		t.Errorf("Expected the second scrape to be served from the cache, got %d refreshes", refreshes)
+		t.Fail()
+	}
+
+	time.Sleep(time.Millisecond * 1100)
+	collectFromCache(cache, refresh)
+	if atomic.LoadInt32(&refreshes) != 2 {
+		t.Errorf("Expected the cache to expire after cachedSecond, got %d refreshes", refreshes)
+		t.Fail()
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var refreshes int32
+	cache := NewCache(1, true)
+	collectFromCache(cache, countingRefresh(&refreshes, 0))
+	time.Sleep(time.Millisecond * 1100)
+
+	start := time.Now()
+	received := collectFromCache(cache, countingRefresh(&refreshes, time.Millisecond*500))
+	if elapsed := time.Since(start); elapsed > time.Millisecond*250 || received != 1 {
+		t.Errorf("Expected stale metrics to be returned immediately, took %s", elapsed)
+		t.Fail()
+	}
+
+	time.Sleep(time.Millisecond * 600)
+	if atomic.LoadInt32(&refreshes) != 2 {
+		t.Errorf("Expected the cache to be refreshed in the background, got %d refreshes", refreshes)
+		t.Fail()
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var refreshes int32
+	cache := NewCache(60, false)
+	refresh := countingRefresh(&refreshes, 0)
+
+	collectFromCache(cache, refresh)
+	cache.Invalidate()
+	collectFromCache(cache, refresh)
+	if atomic.LoadInt32(&refreshes) != 2 {
+		t.Errorf("Expected the cache to be refreshed after invalidation, got %d refreshes", refreshes)
+		t.Fail()
+	}
+}
@@ -0,0 +1,211 @@
+package collector
+
+//
+// catchup.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IntervalTracker keeps, for each rule and metric, the last interval successfully ingested
+// so intervals missed by a failed or late collection are fetched by the next one
+type IntervalTracker struct {
+	mutex        sync.Mutex
+	lastIngested map[string]time.Time
+}
+
+// intervalTracker is the tracker shared by all collectors
+var intervalTracker = NewIntervalTracker()
+
+// NewIntervalTracker returns an empty tracker
+func NewIntervalTracker() *IntervalTracker {
+	return &IntervalTracker{lastIngested: make(map[string]time.Time)}
+}
+
+// Range returns the range of intervals to query, up to the current interval included
+// The range starts after the last ingested interval, bounded by config.maxCatchUp
+func (tracker *IntervalTracker) Range(key string, current time.Time) (time.Time, time.Time) {
+	granularity := GetGranularityDuration(Context.Granularity)
+	end := current.Add(granularity)
+
+	tracker.mutex.Lock()
+	last, present := tracker.lastIngested[key]
+	tracker.mutex.Unlock()
+	if !present || !last.Before(current) {
+		return current, end
+	}
+
+	start := last.Add(granularity)
+	oldest := current.Add(-time.Second * time.Duration(Context.MaxCatchUp))
+	if start.Before(oldest) {
+		start = oldest
+	}
+	return start, end
+}
+
+// Commit records that all intervals up to the current one have been ingested
+func (tracker *IntervalTracker) Commit(key string, current time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if current.After(tracker.lastIngested[key]) {
+		tracker.lastIngested[key] = current
+	}
+}
+
+// backfillWindowKey is the key of the backfilled range of intervals in the context of a collection
+type backfillWindowKey struct{}
+
+// withBackfillWindow returns a context collecting the range of intervals of the window instead of the latest interval
+func withBackfillWindow(ctx context.Context, window timeWindow) context.Context {
+	return context.WithValue(ctx, backfillWindowKey{}, window)
+}
+
+// getBackfillWindow returns the range of intervals backfilled by a collection, false if it is not a backfill
+func getBackfillWindow(ctx context.Context) (timeWindow, bool) {
+	window, present := ctx.Value(backfillWindowKey{}).(timeWindow)
+	return window, present
+}
+
+// currentInterval returns the start of the latest interval to query, aligned on the granularity
+// The last minutes might contain data that is not yet finalized, thus the delay
+func currentInterval(ctx context.Context) time.Time {
+	granularity := GetGranularityDuration(Context.Granularity)
+	if window, backfilling := getBackfillWindow(ctx); backfilling {
+		return window.end.Add(-granularity)
+	}
+	return time.Now().Add(time.Duration(-Context.Delay) * time.Second).Truncate(granularity)
+}
+
+// setQueryInterval sets the intervals of a query: the backfilled range while backfilling, the intervals
+// missed since the last collection if config.maxCatchUp is set, or the latest interval otherwise
+func setQueryInterval(ctx context.Context, query *Query, key string, current time.Time) {
+	if window, backfilling := getBackfillWindow(ctx); backfilling {
+		query.Intervals = []string{formatInterval(window.start, window.end)}
+	} else if Context.MaxCatchUp > 0 {
+		query.Intervals = []string{formatInterval(intervalTracker.Range(key, current))}
+	}
+}
+
+// catchUpKey returns the key of a rule and metric in the interval tracker
+func catchUpKey(rule Rule, ccmetric CCloudCollectorMetric) string {
+	return fmt.Sprintf("%d/%s", rule.id, GetAggregatedMetricKey(ccmetric.metric.Name, ccmetric.aggregation))
+}
+
+// formatInterval returns an interval of the Metrics API, e.g. 2021-01-01T00:00:00Z/2021-01-01T00:05:00Z
+func formatInterval(start time.Time, end time.Time) string {
+	return fmt.Sprintf("%s/%s", start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+}
+
+// DatapointBatch gathers the data points of a response
+// With catch-up, a response contains multiple data points per series, while Prometheus only accepts
+// one sample per series in a scrape: all data points are accumulated, only the latest is sent to Prometheus
+type DatapointBatch struct {
+	ccmetric CCloudCollectorMetric
+	rule     Rule
+	points   []batchedDatapoint
+	// backfilling is set when the data points are written to a file instead of being scraped
+	backfilling bool
+}
+
+type batchedDatapoint struct {
+	labels    []string
+	value     float64
+	timestamp time.Time
+}
+
+// NewDatapointBatch returns an empty batch for a metric collected by a rule
+func NewDatapointBatch(ctx context.Context, ccmetric CCloudCollectorMetric, rule Rule) *DatapointBatch {
+	_, backfilling := getBackfillWindow(ctx)
+	return &DatapointBatch{ccmetric: ccmetric, rule: rule, backfilling: backfilling}
+}
+
+// Add adds a data point to the batch
+func (batch *DatapointBatch) Add(labels []string, value float64, timestamp time.Time) {
+	batch.points = append(batch.points, batchedDatapoint{labels: labels, value: value, timestamp: timestamp})
+}
+
+// Send sends the latest data point of each series to Prometheus, and all data points to the sinks
+func (batch *DatapointBatch) Send(ch chan<- prometheus.Metric) {
+	if !batch.backfilling && dispatcher.Enabled() {
+		dispatcher.Write(batch.datapoints())
+	}
+
+	// Data points are accumulated in chronological order, as older intervals are ignored by the accumulator
+	sort.SliceStable(batch.points, func(i, j int) bool {
+		return batch.points[i].timestamp.Before(batch.points[j].timestamp)
+	})
+
+	latest := make(map[string]time.Time)
+	totals := make(map[string]float64)
+	for _, point := range batch.points {
+		key := strings.Join(point.labels, "\xff")
+		latest[key] = point.timestamp
+		if batch.ccmetric.counterDesc != nil && !point.timestamp.IsZero() {
+			totals[key] = deltaAccumulator.Add(batch.ccmetric.counterDesc, point.labels, point.timestamp, point.value)
+		}
+	}
+
+	for _, point := range batch.points {
+		key := strings.Join(point.labels, "\xff")
+		// While backfilling, data points are written to a file instead of being scraped, thus all are kept
+		if !batch.backfilling && point.timestamp.Before(latest[key]) {
+			continue
+		}
+		sendMetric(ch, prometheus.MustNewConstMetric(batch.ccmetric.desc, prometheus.GaugeValue, point.value, point.labels...), point.timestamp)
+		if total, present := totals[key]; present {
+			sendMetric(ch, prometheus.MustNewConstMetric(batch.ccmetric.counterDesc, prometheus.CounterValue, total, point.labels...), point.timestamp)
+			delete(totals, key)
+		}
+	}
+}
+
+// datapoints returns the data points of the batch, as sent to the sinks
+func (batch *DatapointBatch) datapoints() []Datapoint {
+	points := make([]Datapoint, 0, len(batch.points))
+	for _, point := range batch.points {
+		labels := make(map[string]string, len(point.labels))
+		resource := make(map[string]string)
+		attributes := make(map[string]string)
+		for i, label := range batch.ccmetric.labels {
+			if i >= len(point.labels) {
+				break
+			}
+			labels[label] = point.labels[i]
+			if key, present := batch.ccmetric.resourceLabels[label]; present {
+				resource[key] = point.labels[i]
+			} else {
+				attributes[label] = point.labels[i]
+			}
+		}
+		points = append(points, Datapoint{
+			Name:       batch.ccmetric.name,
+			Metric:     batch.ccmetric.metric,
+			Labels:     labels,
+			Resource:   resource,
+			Attributes: attributes,
+			Value:      point.value,
+			Timestamp:  point.timestamp,
+			Rule:       batch.rule.id,
+		})
+	}
+	return points
+}
+
+func sendMetric(ch chan<- prometheus.Metric, metric prometheus.Metric, timestamp time.Time) {
+	if Context.NoTimestamp || timestamp.IsZero() {
+		ch <- metric
+	} else {
+		ch <- prometheus.NewMetricWithTimestamp(timestamp, metric)
+	}
+}
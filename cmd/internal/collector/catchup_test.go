@@ -0,0 +1,113 @@
+package collector
+
+//
+// catchup_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestIntervalTrackerRange(t *testing.T) {
+	Context = ExporterContext{Granularity: "PT1M", MaxCatchUp: 600}
+	tracker := NewIntervalTracker()
+	current := time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC)
+
+	start, end := tracker.Range("rule", current)
+	if !start.Equal(current) || !end.Equal(current.Add(time.Minute)) {
+		t.Errorf("Expected only the current interval without history, got %s", formatInterval(start, end))
+		t.Fail()
+	}
+
+	// Two intervals have been missed since the last collection
+	tracker.Commit("rule", current.Add(-3*time.Minute))
+	start, _ = tracker.Range("rule", current)
+	if !start.Equal(current.Add(-2 * time.Minute)) {
+		t.Errorf("Expected the missed intervals to be queried, got %s", start)
+		t.Fail()
+	}
+
+	// Older intervals are bounded by config.maxCatchUp
+	tracker.Commit("rule", current.Add(-time.Hour))
+	tracker = NewIntervalTracker()
+	tracker.Commit("rule", current.Add(-time.Hour))
+	start, _ = tracker.Range("rule", current)
+	if !start.Equal(current.Add(-10 * time.Minute)) {
+		t.Errorf("Expected the catch-up to be bounded to 10 minutes, got %s", start)
+		t.Fail()
+	}
+
+	// Committing an older interval does not move the tracker backward
+	tracker.Commit("rule", current)
+	tracker.Commit("rule", current.Add(-5*time.Minute))
+	start, _ = tracker.Range("rule", current)
+	if !start.Equal(current) {
+		t.Errorf("Expected only the current interval once it has been ingested, got %s", start)
+		t.Fail()
+	}
+}
+
+func TestBatchSendsLatestDatapoint(t *testing.T) {
+	Context = ExporterContext{AccumulateDeltas: true}
+	deltaAccumulator = NewDeltaAccumulator()
+	metric := MetricDescription{Name: "io.confluent.kafka.server/received_bytes", Type: "COUNTER_INT64"}
+	ccmetric := CCloudCollectorMetric{
+		metric:      metric,
+		desc:        prometheus.NewDesc("ccloud_metric_received_bytes", "help", []string{"topic"}, nil),
+		counterDesc: newCounterDesc(metric, "ccloud_metric_received_bytes", []string{"topic"}),
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := NewDatapointBatch(context.Background(), ccmetric, Rule{})
+	batch.Add([]string{"orders"}, 5, timestamp.Add(time.Minute))
+	batch.Add([]string{"orders"}, 10, timestamp)
+	batch.Add([]string{"payments"}, 1, timestamp)
+	batch.Send(ch)
+	close(ch)
+
+	gauges := make(map[string]float64)
+	counters := make(map[string]float64)
+	for m := range ch {
+		result := dto.Metric{}
+		m.Write(&result)
+		topic := result.GetLabel()[0].GetValue()
+		if m.Desc() == ccmetric.counterDesc {
+			counters[topic] = result.GetCounter().GetValue()
+		} else {
+			gauges[topic] = result.GetGauge().GetValue()
+		}
+	}
+
+	if len(gauges) != 2 || gauges["orders"] != 5 || gauges["payments"] != 1 {
+		t.Errorf("Expected the latest data point of each series, got %v", gauges)
+		t.Fail()
+	}
+
+	if counters["orders"] != 15 {
+		t.Errorf("Expected every data point to be accumulated, got %v", counters)
+		t.Fail()
+	}
+}
+
+func TestCatchUpRequiresAccumulationOrSink(t *testing.T) {
+	context := ExporterContext{Granularity: "PT1M", Mode: "query", Retry: DefaultRetryPolicy, ScrapeTimeout: 60, MaxCatchUp: 600}
+	if checkConfiguration(&context) == nil {
+		t.Errorf("Expected config.maxCatchUp to require config.accumulateDeltas or a sink")
+		t.Fail()
+	}
+
+	context.AccumulateDeltas = true
+	if err := checkConfiguration(&context); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+	}
+}
@@ -8,6 +8,8 @@ package collector
 //
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -18,24 +20,34 @@ import (
 
 // CCloudCollectorMetric describes a single Metric from Confluent Cloud
 type CCloudCollectorMetric struct {
-	metric   MetricDescription
-	desc     *prometheus.Desc
-	duration *prometheus.GaugeVec
-	labels   []string
-	rule     Rule
-	global   bool
+	name        string
+	metric      MetricDescription
+	desc        *prometheus.Desc
+	counterDesc *prometheus.Desc
+	duration    *prometheus.GaugeVec
+	labels      []string
+	// resourceLabels maps the labels identifying the resource to their key in the Metrics API, e.g. kafka_id to kafka.id
+	resourceLabels map[string]string
+	rule           Rule
+	global         bool
+	aggregation    string
 }
 
 // CCloudCollector is a custom prometheu collector to collect data from
 // Confluent Cloud Metrics API
+// Until the descriptors of the Metrics API have been discovered, only
+// the metrics describing the exporter itself are collected
 type CCloudCollector struct {
-	metrics                 map[string]CCloudCollectorMetric
-	rules                   []Rule
-	kafkaCollector          *KafkaCCloudCollector
-	connectorCollector      *ConnectorCCloudCollector
-	ksqlCollector           *KsqlCCloudCollector
-	schemaRegistryCollector *SchemaRegistryCCloudCollector
-	cache                   *CCloudCollectorCache
+	mutex              sync.RWMutex
+	ready              bool
+	metrics            map[string]CCloudCollectorMetric
+	rules              []Rule
+	kafkaCollector     *KafkaCCloudCollector
+	resourceCollectors []*ResourceCCloudCollector
+	exportCollector    *ExportCCloudCollector
+	descriptors        map[string]MetricDescription
+	cache              *CCloudCollectorCache
+	store              *MetricStore
 }
 
 var (
@@ -43,109 +55,312 @@ var (
 )
 
 // Describe collect all metrics for ccloudexporter
-func (cc CCloudCollector) Describe(ch chan<- *prometheus.Desc) {
-	cc.kafkaCollector.Describe(ch)
-	cc.connectorCollector.Describe(ch)
-	cc.ksqlCollector.Describe(ch)
-	cc.schemaRegistryCollector.Describe(ch)
+func (cc *CCloudCollector) Describe(ch chan<- *prometheus.Desc) {
+	cc.mutex.RLock()
+	defer cc.mutex.RUnlock()
+
+	if cc.ready && cc.exportCollector != nil {
+		cc.exportCollector.Describe(ch)
+	} else if cc.ready {
+		if cc.kafkaCollector != nil {
+			cc.kafkaCollector.Describe(ch)
+		}
+		for _, resourceCollector := range cc.resourceCollectors {
+			resourceCollector.Describe(ch)
+		}
+	}
+	describeInstrumentation(ch)
 }
 
 // Collect all metrics for Prometheus
 // to avoid reaching the scrape_timeout, metrics are fetched in multiple goroutine
-func (cc CCloudCollector) Collect(ch chan<- prometheus.Metric) {
-	if Context.CachedSecond > 0 {
-		cc.collectWithtCache(ch)
-	} else {
-		cc.collectWithoutCache(ch)
+func (cc *CCloudCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.mutex.RLock()
+	ready := cc.ready
+	cc.mutex.RUnlock()
+
+	if ready {
+		if Context.PollInterval > 0 {
+			cc.store.SendToChan(ch)
+		} else if Context.CachedSecond > 0 {
+			cc.cache.Collect(ch, cc.collectAllCollectors)
+		} else {
+			cc.collectAllCollectors(ch)
+		}
 	}
+	collectInstrumentation(ch)
 }
 
-func (cc CCloudCollector) collectWithoutCache(ch chan<- prometheus.Metric) {
-	cc.collectAllCollectors(ch)
+func (cc *CCloudCollector) collectAllCollectors(ch chan<- prometheus.Metric) {
+	cc.collectWithContext(context.Background(), ch)
 }
 
-func (cc CCloudCollector) collectWithtCache(ch chan<- prometheus.Metric) {
-	if cc.cache.MaybeSendToChan(ch) {
-		return
-	}
-
-	var wgCache sync.WaitGroup
-	cachedChan := make(chan prometheus.Metric)
-	cc.cache.Hijack(cachedChan, ch, &wgCache)
-	cc.collectAllCollectors(cachedChan)
+// collectWithContext collects all metrics, the scrape timeout is added to the parent context
+func (cc *CCloudCollector) collectWithContext(parent context.Context, ch chan<- prometheus.Metric) {
+	kafkaCollector, resourceCollectors, exportCollector := cc.collectors()
 
-	close(cachedChan)
-	wgCache.Wait()
-}
+	ctx, cancel := context.WithTimeout(parent, time.Second*time.Duration(Context.ScrapeTimeout))
+	defer cancel()
 
-func (cc CCloudCollector) collectAllCollectors(ch chan<- prometheus.Metric) {
 	var wg sync.WaitGroup
-	cc.kafkaCollector.Collect(ch, &wg)
-	cc.connectorCollector.Collect(ch, &wg)
-	cc.ksqlCollector.Collect(ch, &wg)
-	cc.schemaRegistryCollector.Collect(ch, &wg)
+	if exportCollector != nil {
+		exportCollector.Collect(ctx, ch, &wg)
+		wg.Wait()
+		return
+	}
+
+	if kafkaCollector != nil {
+		kafkaCollector.Collect(ctx, ch, &wg)
+	}
+	for _, resourceCollector := range resourceCollectors {
+		resourceCollector.Collect(ctx, ch, &wg)
+	}
 	wg.Wait()
 }
 
-
+// collectors returns the collectors currently in use
+// The lock is only held while they are copied, so a discovery or a reload is not blocked by the queries in flight
+func (cc *CCloudCollector) collectors() (*KafkaCCloudCollector, []*ResourceCCloudCollector, *ExportCCloudCollector) {
+	cc.mutex.RLock()
+	defer cc.mutex.RUnlock()
+	return cc.kafkaCollector, cc.resourceCollectors, cc.exportCollector
+}
 
 // NewCCloudCollector creates a new instance of the collector
 // During the creation, we invoke the descriptor endpoint to fetcha all
-// existing metrics and their labels
-func NewCCloudCollector() CCloudCollector {
+// existing metrics and their labels.
+// If the descriptor endpoint can not be reached, the discovery is retried in
+// the background, unless Context.FailFast is set, in which case the process exits.
+func NewCCloudCollector() *CCloudCollector {
+	initHTTPClient()
+	dispatcher.SetSinks(newConfiguredSinks())
+	go dispatcher.FlushLoop()
 
+	// Resources are discovered before the descriptors, so collectors are created with the discovered rules
+	if isDiscoveryConfigured() {
+		_, err := refreshDiscoveredResources()
+		if err != nil && Context.FailFast {
+			log.WithError(err).Fatalln("Can not discover the resources of the organization")
+		} else if err != nil {
+			log.WithError(err).Errorln("Can not discover the resources of the organization, retrying in the background")
+		}
+	}
+
+	cache := NewCache(Context.CachedSecond, Context.StaleWhileRevalidate)
+	collector := &CCloudCollector{rules: Context.GetRules(), metrics: make(map[string]CCloudCollectorMetric), cache: cache, store: NewMetricStore()}
+	exporterUp.Set(0)
+	configLastReloadSuccess.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	go collector.refreshResources()
+	go refreshTopics()
+	if Context.PollInterval > 0 {
+		go collector.poll()
+	}
+
+	if Context.FailFast {
+		err := collector.discover()
+		if err != nil {
+			log.WithError(err).Fatalln("Can not discover the metrics exposed by the Metrics API")
+		}
+		go collector.refreshDescriptors()
+	} else {
+		go func() {
+			collector.discoverUntilReady()
+			collector.refreshDescriptors()
+		}()
+	}
+
+	return collector
+}
+
+// initHTTPClient creates the HTTP client shared by all requests to Confluent Cloud, and the rate limiter of the Metrics API
+func initHTTPClient() {
 	log.Traceln("Creating http client")
 	httpClient = http.Client{
 		Timeout: time.Second * time.Duration(Context.HTTPTimeout),
 	}
+	limiter = NewRequestLimiter(Context.MaxRequestsPerSecond, Context.MaxConcurrentRequests)
+}
+
+// discoverUntilReady invokes the descriptor endpoints until it succeeds
+// Rules that are not valid for the described metrics are a configuration error, thus they are not retried
+func (cc *CCloudCollector) discoverUntilReady() {
+	for attempt := 1; ; attempt++ {
+		err := cc.discover()
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errUnsupportedAggregation) {
+			log.WithError(err).Fatalln("Invalid configuration")
+		}
+
+		backoff := Context.Retry.backoff(attempt, nil)
+		log.WithError(err).WithField("backoff", backoff).Errorln("Can not discover the metrics exposed by the Metrics API, retrying")
+		time.Sleep(backoff)
+	}
+}
+
+// refreshDescriptors periodically invokes the descriptor endpoints, so metrics and labels
+// added to the Metrics API are collected without restarting the exporter
+func (cc *CCloudCollector) refreshDescriptors() {
+	if Context.DescriptorRefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(Context.DescriptorRefreshInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		err := cc.discover()
+		if err != nil {
+			log.WithError(err).Errorln("Can not refresh the metrics exposed by the Metrics API, previous descriptors are kept")
+		}
+	}
+}
+
+// refreshResources periodically discovers the resources of the organization
+// When resources are added or removed, the collectors are recreated with the new rules
+// Rules might be reloaded, thus the discovery is skipped while no rule relies on it
+func (cc *CCloudCollector) refreshResources() {
+	if Context.Discovery.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(Context.Discovery.Interval))
+	defer ticker.Stop()
+	for range ticker.C {
+		if !isDiscoveryConfigured() {
+			continue
+		}
 
-	var (
-		connectorResource      ResourceDescription
-		kafkaResource          ResourceDescription
-		ksqlResource           ResourceDescription
-		schemaRegistryResource ResourceDescription
-	)
-	resourceDescription := SendResourceDescriptorQuery()
+		changed, err := refreshDiscoveredResources()
+		if err != nil {
+			log.WithError(err).Errorln("Can not refresh the resources of the organization, previous resources are kept")
+			continue
+		}
+
+		cc.mutex.RLock()
+		ready := cc.ready
+		cc.mutex.RUnlock()
+		// Until the collector is ready, the descriptor discovery picks up the new rules by itself
+		if !changed {
+			continue
+		}
+		refreshResolvedTopics()
+		if !ready {
+			continue
+		}
+
+		err = cc.discover()
+		if err != nil {
+			log.WithError(err).Errorln("Can not recreate the collectors for the discovered resources")
+		}
+	}
+}
+
+// discover fetches all resources and metrics exposed by the Metrics API
+// and creates the collectors for each resource type
+func (cc *CCloudCollector) discover() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Context.ScrapeTimeout))
+	defer cancel()
+
+	resourceDescription, err := SendResourceDescriptorQuery(ctx)
+	if err != nil {
+		return err
+	}
+
+	var kafkaCollector *KafkaCCloudCollector
+	resourceCollectors := make([]*ResourceCCloudCollector, 0)
+	collectedMetrics := make(map[string]bool)
+	descriptors := make(map[string]MetricDescription)
 	for _, resource := range resourceDescription.Data {
-		if resource.Type == "connector" {
-			connectorResource = resource
-		} else if resource.Type == "kafka" {
-			kafkaResource = resource
-		} else if resource.Type == "ksql" {
-			ksqlResource = resource
-		} else if resource.Type == "schema_registry" {
-			schemaRegistryResource = resource
+		if resource.Type == "kafka" {
+			collector, err := NewKafkaCCloudCollector(ctx, cc, resource)
+			if err != nil {
+				return err
+			}
+			for metric := range collector.metrics {
+				collectedMetrics[metric] = true
+			}
+			for _, descriptor := range collector.descriptors {
+				descriptors[descriptor.Name] = descriptor
+			}
+			kafkaCollector = &collector
+			continue
 		}
+
+		collector, err := NewResourceCCloudCollector(ctx, cc, resource)
+		if err != nil {
+			return err
+		}
+		for metric := range collector.metrics {
+			collectedMetrics[metric] = true
+		}
+		for _, descriptor := range collector.descriptors {
+			descriptors[descriptor.Name] = descriptor
+		}
+		resourceCollectors = append(resourceCollectors, &collector)
 	}
 
-	if connectorResource.Type == "" {
-		log.WithField("descriptorResponse", resourceDescription).Fatalln("No connector resource available")
+	if kafkaCollector == nil {
+		log.WithField("descriptorResponse", resourceDescription).Warnln("No kafka resource available")
 	}
 
-	if kafkaResource.Type == "" {
-		log.WithField("descriptorResponse", resourceDescription).Fatalln("No kafka resource available")
+	// Aggregations can only be validated once the types of the metrics are known
+	err = checkRulesAggregations(Context.GetRules(), descriptors)
+	if err != nil {
+		return err
 	}
+	setDescribedMetrics(descriptors)
 
-	if ksqlResource.Type == "" {
-		log.WithField("descriptorResponse", resourceDescription).Fatalln("No ksqlDB resource available")
+	ignoredMetrics := make([]string, 0)
+	for _, metric := range Context.GetMetrics() {
+		if !collectedMetrics[metric] {
+			ignoredMetrics = append(ignoredMetrics, metric)
+		}
+	}
+	if len(ignoredMetrics) > 0 {
+		log.WithField("Ignored metrics", ignoredMetrics).Warnln("The following metrics will not be gathered as they are not exposed by the Metrics API")
 	}
 
-	if schemaRegistryResource.Type == "" {
-		log.WithField("descriptorResponse", resourceDescription).Fatalln("No SchemaRegistry resource available")
+	var exportCollector *ExportCCloudCollector
+	if Context.Mode == "export" {
+		collector := NewExportCCloudCollector(kafkaCollector, resourceCollectors)
+		exportCollector = &collector
 	}
 
-	collector := CCloudCollector{rules: Context.Rules, metrics: make(map[string]CCloudCollectorMetric)}
-	kafkaCollector := NewKafkaCCloudCollector(collector, kafkaResource)
-	connectorCollector := NewConnectorCCloudCollector(collector, connectorResource)
-	ksqlCollector := NewKsqlCCloudCollector(collector, ksqlResource)
-	schemaRegistryCollector := NewSchemaRegistryCCloudCollector(collector, schemaRegistryResource)
-	cache := NewCache(Context.CachedSecond)
+	cc.mutex.Lock()
+	previousDescriptors := cc.descriptors
+	wasReady := cc.ready
+	cc.rules = Context.GetRules()
+	cc.kafkaCollector = kafkaCollector
+	cc.resourceCollectors = resourceCollectors
+	cc.exportCollector = exportCollector
+	cc.descriptors = descriptors
+	cc.cache.Invalidate()
+	cc.ready = true
+	cc.mutex.Unlock()
 
-	collector.kafkaCollector = &kafkaCollector
-	collector.connectorCollector = &connectorCollector
-	collector.ksqlCollector = &ksqlCollector
-	collector.schemaRegistryCollector = &schemaRegistryCollector
-	collector.cache = &cache
+	exporterUp.Set(1)
+	descriptorLastRefresh.SetToCurrentTime()
+	if !wasReady {
+		log.Infoln("Metrics and resources exposed by the Metrics API have been discovered")
+		return nil
+	}
 
-	return collector
+	diff := DiffDescriptors(previousDescriptors, descriptors)
+	if diff.IsEmpty() {
+		log.Debugln("Metrics and resources exposed by the Metrics API have not changed")
+		return nil
+	}
+	descriptorChanges.WithLabelValues("metric", "added").Add(float64(len(diff.AddedMetrics)))
+	descriptorChanges.WithLabelValues("metric", "removed").Add(float64(len(diff.RemovedMetrics)))
+	descriptorChanges.WithLabelValues("label", "added").Add(float64(len(diff.AddedLabels)))
+	descriptorChanges.WithLabelValues("label", "removed").Add(float64(len(diff.RemovedLabels)))
+	log.WithFields(log.Fields{
+		"addedMetrics":   diff.AddedMetrics,
+		"removedMetrics": diff.RemovedMetrics,
+		"addedLabels":    diff.AddedLabels,
+		"removedLabels":  diff.RemovedLabels,
+	}).Infoln("Metrics exposed by the Metrics API have changed")
+	return nil
 }
@@ -0,0 +1,219 @@
+package collector
+
+//
+// collector_export.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportCCloudCollector is a custom prometheus collector to collect data from
+// the export endpoint of the Confluent Cloud Metrics API.
+// The export endpoint returns all metrics of a set of resources in the Prometheus
+// text format, metrics are filtered and renamed according to the rules
+type ExportCCloudCollector struct {
+	rules     []Rule
+	metrics   map[string]CCloudCollectorMetric
+	resources map[string]ResourceDescription
+	duration  *prometheus.GaugeVec
+}
+
+var (
+	exportURI             = "v2/metrics/cloud/export"
+	invalidExportNameChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// Describe collect all metrics for ccloudexporter
+func (cc ExportCCloudCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range cc.metrics {
+		ch <- desc.desc
+		if desc.counterDesc != nil {
+			ch <- desc.counterDesc
+		}
+	}
+	cc.duration.Describe(ch)
+}
+
+// Collect all metrics for Prometheus
+// One request to the export endpoint is sent per rule, in multiple goroutine
+func (cc ExportCCloudCollector) Collect(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup) {
+	for _, rule := range cc.rules {
+		cc.CollectRule(ctx, ch, wg, rule)
+	}
+}
+
+// CollectRule collects all metrics of a single rule
+func (cc ExportCCloudCollector) CollectRule(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup, rule Rule) {
+	wg.Add(1)
+	go cc.CollectMetricsForRule(ctx, wg, ch, rule)
+}
+
+// CollectMetricsForRule collects all metrics for a specific rule
+func (cc ExportCCloudCollector) CollectMetricsForRule(ctx context.Context, wg *sync.WaitGroup, ch chan<- prometheus.Metric, rule Rule) {
+	defer wg.Done()
+	endpoint := Context.HTTPBaseURL + exportURI + "?" + cc.exportParameters(rule).Encode()
+	log.WithFields(log.Fields{"endpoint": endpoint}).Traceln("Scraping the export endpoint")
+
+	durationMetric, _ := cc.duration.GetMetricWithLabelValues(strconv.Itoa(rule.id))
+	timer := prometheus.NewTimer(prometheus.ObserverFunc(durationMetric.Set))
+	res, body, err := SendWithRetry(ctx, func() (*http.Request, error) {
+		return NewRequest("GET", endpoint, nil)
+	})
+	timer.ObserveDuration()
+	ch <- durationMetric
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"endpoint": endpoint}).Errorln("Export did not succeed")
+		failedQueries.Inc()
+		reportRuleError(ctx, rule, fmt.Errorf("export did not succeed: %s", err))
+		return
+	}
+	if res.StatusCode != 200 {
+		log.WithFields(log.Fields{"StatusCode": res.StatusCode, "Endpoint": endpoint, "body": string(body)}).Errorln("Received invalid response")
+		failedQueries.Inc()
+		reportRuleError(ctx, rule, fmt.Errorf("export received status code %d", res.StatusCode))
+		return
+	}
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"endpoint": endpoint}).Errorln("Can not parse the response of the export endpoint")
+		failedQueries.Inc()
+		reportRuleError(ctx, rule, fmt.Errorf("can not parse the response of the export endpoint: %s", err))
+		return
+	}
+	cc.handleResponse(ctx, families, ch, rule)
+}
+
+// exportParameters returns the resource filters of the export endpoint for a rule
+func (cc ExportCCloudCollector) exportParameters(rule Rule) url.Values {
+	parameters := url.Values{}
+	for _, cluster := range rule.Clusters {
+		parameters.Add("resource.kafka.id", cluster)
+	}
+	for resourceType, ids := range rule.Resources {
+		resource, present := cc.resources[resourceType]
+		if !present {
+			continue
+		}
+		for _, id := range ids {
+			parameters.Add("resource."+resource.idLabel(), id)
+		}
+	}
+	return parameters
+}
+
+func (cc ExportCCloudCollector) handleResponse(ctx context.Context, families map[string]*dto.MetricFamily, ch chan<- prometheus.Metric, rule Rule) {
+	for name, family := range families {
+		ccmetric, present := cc.metrics[name]
+		if !present || !contains(rule.Metrics, ccmetric.metric.Name) {
+			continue
+		}
+
+		batch := NewDatapointBatch(ctx, ccmetric, rule)
+		for _, sample := range family.GetMetric() {
+			sampleLabels := make(map[string]string)
+			for _, label := range sample.GetLabel() {
+				sampleLabels[label.GetName()] = label.GetValue()
+			}
+
+			topic, topicPresent := sampleLabels["topic"]
+			cluster, clusterPresent := sampleLabels["kafka_id"]
+			if topicPresent && !rule.MatchesTopic(topic) {
+				continue
+			}
+			if topicPresent && clusterPresent && rule.ShouldIgnoreResultForRule(topic, cluster, ccmetric.metric.Name) {
+				continue
+			}
+
+			labels := []string{}
+			for _, label := range ccmetric.labels {
+				// For compatibility reason, kafka_id label is also added as cluster_id
+				if label == "cluster_id" {
+					label = "kafka_id"
+				}
+				labels = append(labels, sampleLabels[label])
+			}
+
+			timestamp := time.Time{}
+			if sample.TimestampMs != nil {
+				timestamp = time.Unix(0, sample.GetTimestampMs()*int64(time.Millisecond))
+			}
+			batch.Add(labels, sampleValue(sample), timestamp)
+		}
+		batch.Send(ch)
+	}
+}
+
+func sampleValue(sample *dto.Metric) float64 {
+	if sample.Gauge != nil {
+		return sample.Gauge.GetValue()
+	}
+	if sample.Counter != nil {
+		return sample.Counter.GetValue()
+	}
+	return sample.Untyped.GetValue()
+}
+
+// GetExportNameForMetric returns the name of a metric as returned by the export endpoint
+// e.g. io.confluent.kafka.server/received_bytes is exported as confluent_kafka_server_received_bytes
+func GetExportNameForMetric(metric MetricDescription) string {
+	return invalidExportNameChar.ReplaceAllString(strings.TrimPrefix(metric.Name, "io."), "_")
+}
+
+// NewExportCCloudCollector create a new collector for the export endpoint
+// The metrics discovered by the query collectors are reused to describe and rename the exported metrics
+func NewExportCCloudCollector(kafkaCollector *KafkaCCloudCollector, resourceCollectors []*ResourceCCloudCollector) ExportCCloudCollector {
+	collector := ExportCCloudCollector{
+		rules:     Context.GetRules(),
+		metrics:   make(map[string]CCloudCollectorMetric),
+		resources: make(map[string]ResourceDescription),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ccloud_metrics_api_export_latency",
+			Help: "Metrics API export endpoint request latency",
+		}, []string{"ruleNumber"}),
+	}
+
+	if kafkaCollector != nil {
+		for _, metric := range kafkaCollector.metrics {
+			if metric.aggregation != "" {
+				continue
+			}
+			collector.metrics[GetExportNameForMetric(metric.metric)] = metric
+		}
+		collector.resources[kafkaCollector.resource.Type] = kafkaCollector.resource
+	}
+	for _, resourceCollector := range resourceCollectors {
+		for _, metric := range resourceCollector.metrics {
+			if metric.aggregation != "" {
+				continue
+			}
+			collector.metrics[GetExportNameForMetric(metric.metric)] = metric
+		}
+		collector.resources[resourceCollector.resource.Type] = resourceCollector.resource
+	}
+
+	if len(collector.metrics) == 0 {
+		log.Warnln("No metric will be exported, none of the metrics of the rules are exposed by the Metrics API")
+	}
+
+	return collector
+}
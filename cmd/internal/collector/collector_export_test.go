@@ -0,0 +1,100 @@
+package collector
+
+//
+// collector_export_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestExportCollector(t *testing.T) {
+	var requestedClusters []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedClusters = r.URL.Query()["resource.kafka.id"]
+		fmt.Fprint(w, `# HELP confluent_kafka_server_received_bytes The delta count of bytes received.
+# TYPE confluent_kafka_server_received_bytes gauge
+confluent_kafka_server_received_bytes{kafka_id="lkc-1",topic="orders"} 42.0 1609459200000
+confluent_kafka_server_received_bytes{kafka_id="lkc-1",topic="payments"} 12.0 1609459200000
+# HELP confluent_kafka_server_sent_bytes The delta count of bytes sent.
+# TYPE confluent_kafka_server_sent_bytes gauge
+confluent_kafka_server_sent_bytes{kafka_id="lkc-1",topic="orders"} 1.0 1609459200000
+`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	rule := Rule{
+		id:            0,
+		Clusters:      []string{"lkc-1"},
+		Topics:        []string{"orders"},
+		Metrics:       []string{"io.confluent.kafka.server/received_bytes"},
+		GroupByLabels: []string{"kafka.id", "topic"},
+	}
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", Rules: []Rule{rule}, Retry: RetryPolicy{MaxAttempts: 1}}
+
+	metric := CCloudCollectorMetric{
+		labels: []string{"kafka_id", "cluster_id", "topic"},
+		metric: MetricDescription{Name: "io.confluent.kafka.server/received_bytes"},
+		desc:   prometheus.NewDesc("ccloud_metric_received_bytes", "help", []string{"kafka_id", "cluster_id", "topic"}, nil),
+	}
+	kafkaCollector := KafkaCCloudCollector{
+		metrics: map[string]CCloudCollectorMetric{
+			"io.confluent.kafka.server/received_bytes": metric,
+		},
+		resource: ResourceDescription{Type: "kafka", Labels: []MetricLabel{{Key: "kafka.id"}}},
+	}
+	collector := NewExportCCloudCollector(&kafkaCollector, nil)
+
+	var wg sync.WaitGroup
+	pchan := make(chan prometheus.Metric, 10)
+	collector.Collect(context.Background(), pchan, &wg)
+	wg.Wait()
+	close(pchan)
+
+	if len(requestedClusters) != 1 || requestedClusters[0] != "lkc-1" {
+		t.Errorf("Unexpected resource filter: %s", requestedClusters)
+		t.Fail()
+	}
+
+	results := make([]dto.Metric, 0)
+	for m := range pchan {
+		if m.Desc() != metric.desc {
+			continue
+		}
+		result := dto.Metric{}
+		m.Write(&result)
+		results = append(results, result)
+	}
+
+	if len(results) != 1 {
+		t.Errorf("Expected only the orders topic to be exported, got %d metrics", len(results))
+		t.Fail()
+		return
+	}
+
+	if results[0].GetGauge().GetValue() != 42 || results[0].GetTimestampMs() != 1609459200000 {
+		t.Errorf("Unexpected metric: %+v", results[0])
+		t.Fail()
+	}
+
+	for _, label := range results[0].Label {
+		if label.GetName() == "cluster_id" && label.GetValue() != "lkc-1" {
+			t.Errorf("Expected cluster_id to be populated from kafka_id, got %s", label.GetValue())
+			t.Fail()
+		}
+	}
+}
@@ -8,9 +8,12 @@ package collector
 //
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,62 +23,107 @@ import (
 // KafkaCCloudCollector is a custom prometheu collector to collect data from
 // Confluent Cloud Metrics API. It fetches Kafka resources types metrics
 type KafkaCCloudCollector struct {
-	metrics  map[string]CCloudCollectorMetric
-	rules    []Rule
-	ccloud   CCloudCollector
-	resource ResourceDescription
+	metrics     map[string]CCloudCollectorMetric
+	descriptors []MetricDescription
+	rules       []Rule
+	ccloud      *CCloudCollector
+	resource    ResourceDescription
 }
 
 // Describe collect all metrics for ccloudexporter
 func (cc KafkaCCloudCollector) Describe(ch chan<- *prometheus.Desc) {
 	for _, desc := range cc.metrics {
 		ch <- desc.desc
+		if desc.counterDesc != nil {
+			ch <- desc.counterDesc
+		}
 		desc.duration.Describe(ch)
 	}
 }
 
 // Collect all metrics for Prometheus
 // to avoid reaching the scrape_timeout, metrics are fetched in multiple goroutine
-func (cc KafkaCCloudCollector) Collect(ch chan<- prometheus.Metric, wg *sync.WaitGroup) {
+func (cc KafkaCCloudCollector) Collect(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup) {
 	for _, rule := range cc.rules {
-		for _, metric := range rule.Metrics {
-			_, present := cc.metrics[metric]
-			if !present {
-				continue
-			}
-			if len(rule.Clusters) <= 0 {
-				log.WithFields(log.Fields{"rule": rule}).Errorln("Kafka rule has no cluster specified")
-				continue
-			}
+		cc.CollectRule(ctx, ch, wg, rule)
+	}
+}
 
-			wg.Add(1)
-			go cc.CollectMetricsForRule(wg, ch, rule, cc.metrics[metric])
+// CollectRule collects all metrics of a single rule, one goroutine is started per metric
+func (cc KafkaCCloudCollector) CollectRule(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup, rule Rule) {
+	for _, metric := range rule.Metrics {
+		ccmetric, present := cc.metrics[GetAggregatedMetricKey(metric, rule.GetAggregation(metric))]
+		if !present {
+			continue
+		}
+		if len(rule.Clusters) <= 0 {
+			log.WithFields(log.Fields{"rule": rule}).Errorln("Kafka rule has no cluster specified")
+			reportRuleError(ctx, rule, errors.New("no cluster is specified"))
+			continue
 		}
+
+		wg.Add(1)
+		go cc.CollectMetricsForRule(ctx, wg, ch, rule, ccmetric)
 	}
 }
 
 // CollectMetricsForRule collects all metrics for a specific rule
-func (cc KafkaCCloudCollector) CollectMetricsForRule(wg *sync.WaitGroup, ch chan<- prometheus.Metric, rule Rule, ccmetric CCloudCollectorMetric) {
+func (cc KafkaCCloudCollector) CollectMetricsForRule(ctx context.Context, wg *sync.WaitGroup, ch chan<- prometheus.Metric, rule Rule, ccmetric CCloudCollectorMetric) {
 	defer wg.Done()
-	query := BuildQuery(ccmetric.metric, rule.Clusters, rule.GroupByLabels, rule.Topics, cc.resource)
-	log.WithFields(log.Fields{"query": query}).Traceln("The following query has been created")
-	optimizedQuery, additionalLabels := OptimizeQuery(query)
-	log.WithFields(log.Fields{"optimizedQuery": optimizedQuery, "additionalLabels": additionalLabels}).Traceln("Query has been optimized")
 	durationMetric, _ := ccmetric.duration.GetMetricWithLabelValues(strconv.Itoa(rule.id))
 	timer := prometheus.NewTimer(prometheus.ObserverFunc(durationMetric.Set))
-	response, err := SendQuery(optimizedQuery)
+
+	topics, ok := rule.GetTopics()
+	if !ok {
+		log.WithField("rule", rule.id).Debugln("No topic matches the topic patterns of the rule, skipping the query")
+		return
+	}
+
+	current := currentInterval(ctx)
+
+	// Rules with too many topics are split in multiple queries, sent concurrently
+	var shardsWg sync.WaitGroup
+	var failedShards int32
+	for _, query := range BuildQueries(ccmetric.metric, rule.Clusters, rule.GroupByLabels, topics, cc.resource) {
+		query.Aggreations[0].Agg = ccmetric.aggregation
+		setQueryInterval(ctx, &query, catchUpKey(rule, ccmetric), current)
+		shardsWg.Add(1)
+		go func(query Query) {
+			defer shardsWg.Done()
+			if !cc.collectQuery(ctx, ch, rule, ccmetric, query) {
+				atomic.AddInt32(&failedShards, 1)
+			}
+		}(query)
+	}
+	shardsWg.Wait()
+	if failedShards == 0 {
+		intervalTracker.Commit(catchUpKey(rule, ccmetric), current)
+	}
+
 	timer.ObserveDuration()
 	ch <- durationMetric
+}
+
+// collectQuery sends a query and handles its response, it returns false if the query failed
+func (cc KafkaCCloudCollector) collectQuery(ctx context.Context, ch chan<- prometheus.Metric, rule Rule, ccmetric CCloudCollectorMetric, query Query) bool {
+	log.WithFields(log.Fields{"query": query}).Traceln("The following query has been created")
+	optimizedQuery, additionalLabels := OptimizeQuery(query)
+	log.WithFields(log.Fields{"optimizedQuery": optimizedQuery, "additionalLabels": additionalLabels}).Traceln("Query has been optimized")
+	response, err := SendQuery(ctx, optimizedQuery)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{"optimizedQuery": optimizedQuery, "response": response}).Errorln("Query did not succeed")
-		return
+		failedQueries.Inc()
+		reportRuleError(ctx, rule, fmt.Errorf("query of %s did not succeed: %s", ccmetric.metric.Name, err))
+		return false
 	}
 	log.WithFields(log.Fields{"response": response}).Traceln("Response has been received")
-	cc.handleResponse(response, ccmetric, ch, rule, additionalLabels)
+	cc.handleResponse(ctx, response, ccmetric, ch, rule, additionalLabels)
+	return true
 }
 
-func (cc KafkaCCloudCollector) handleResponse(response QueryResponse, ccmetric CCloudCollectorMetric, ch chan<- prometheus.Metric, rule Rule, additionalLabels map[string]string) {
-	desc := ccmetric.desc
+func (cc KafkaCCloudCollector) handleResponse(ctx context.Context, response QueryResponse, ccmetric CCloudCollectorMetric, ch chan<- prometheus.Metric, rule Rule, additionalLabels map[string]string) {
+	batch := NewDatapointBatch(ctx, ccmetric, rule)
+	defer batch.Send(ch)
 	for _, dataPoint := range response.Data {
 		// Some data points might need to be ignored if it is the global query
 		topic, topicPresent := dataPoint["metric.topic"].(string)
@@ -93,6 +141,11 @@ func (cc KafkaCCloudCollector) handleResponse(response QueryResponse, ccmetric C
 			continue
 		}
 
+		// Topics resolved from patterns might be outdated, e.g. a topic that is now excluded
+		if topicPresent && !rule.MatchesTopic(topic) {
+			continue
+		}
+
 		value, ok := dataPoint["value"].(float64)
 		if !ok {
 			log.WithField("datapoint", dataPoint["value"]).Errorln("Can not convert result to float")
@@ -113,83 +166,81 @@ func (cc KafkaCCloudCollector) handleResponse(response QueryResponse, ccmetric C
 			labels = append(labels, labelValue)
 		}
 
-		metric := prometheus.MustNewConstMetric(
-			desc,
-			prometheus.GaugeValue,
-			value,
-			labels...,
-		)
-
-		if Context.NoTimestamp {
-			ch <- metric
-		} else {
-			timestamp, err := time.Parse(time.RFC3339, fmt.Sprint(dataPoint["timestamp"]))
-			if err != nil {
-				log.WithError(err).Errorln("Can not parse timestamp, ignoring the response")
-				return
-			}
-			metricWithTime := prometheus.NewMetricWithTimestamp(timestamp, metric)
-			ch <- metricWithTime
+		timestamp, err := time.Parse(time.RFC3339, fmt.Sprint(dataPoint["timestamp"]))
+		if err != nil {
+			log.WithError(err).Errorln("Can not parse timestamp, ignoring the response")
+			return
 		}
+		batch.Add(labels, value, timestamp)
 	}
 }
 
 // NewKafkaCCloudCollector create a new Confluent Cloud Kafka collector
-func NewKafkaCCloudCollector(ccloudcollecter CCloudCollector, resource ResourceDescription) KafkaCCloudCollector {
+func NewKafkaCCloudCollector(ctx context.Context, ccloudcollecter *CCloudCollector, resource ResourceDescription) (KafkaCCloudCollector, error) {
 	collector := KafkaCCloudCollector{
 		rules:    Context.GetKafkaRules(),
 		metrics:  make(map[string]CCloudCollectorMetric),
 		resource: resource,
 		ccloud:   ccloudcollecter,
 	}
-	descriptorResponse := SendDescriptorQuery(resource.Type)
+	descriptorResponse, err := SendDescriptorQuery(ctx, resource.Type)
+	if err != nil {
+		return collector, err
+	}
 	log.WithField("descriptor response", descriptorResponse).Traceln("The following response for the descriptor endpoint has been received")
-	mapOfWhiteListedMetrics := Context.GetMapOfMetrics("io.confluent.kafka.server")
+	collector.descriptors = descriptorResponse.Data
+	mapOfWhiteListedMetrics := Context.GetMapOfMetrics("")
 
 	for _, metr := range descriptorResponse.Data {
 		_, metricPresent := mapOfWhiteListedMetrics[metr.Name]
 		if !metricPresent {
 			continue
 		}
-		delete(mapOfWhiteListedMetrics, metr.Name)
 
 		var labels []string
+		resourceLabels := make(map[string]string)
 		for _, rsrcLabel := range resource.Labels {
 			labels = append(labels, GetPrometheusNameForLabel(rsrcLabel.Key))
+			resourceLabels[GetPrometheusNameForLabel(rsrcLabel.Key)] = rsrcLabel.Key
 			// For retro-compatibility, kafka_id is also exposed as cluster_id
 			if rsrcLabel.Key == "kafka.id" {
 				labels = append(labels, "cluster_id")
+				resourceLabels["cluster_id"] = rsrcLabel.Key
 			}
 		}
 		for _, metrLabel := range metr.Labels {
 			labels = append(labels, metrLabel.Key)
 		}
 
-		desc := prometheus.NewDesc(
-			"ccloud_metric_"+GetNiceNameForMetric(metr),
-			metr.Description,
-			labels,
-			nil,
-		)
-
 		requestDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name:        "ccloud_metrics_api_request_latency",
 			Help:        "Metrics API request latency",
 			ConstLabels: map[string]string{"metric": metr.Name},
 		}, []string{"ruleNumber"})
 
-		metric := CCloudCollectorMetric{
-			metric:   metr,
-			desc:     desc,
-			duration: requestDuration,
-			labels:   labels,
+		// The same metric might be collected with different aggregations, one Prometheus metric is created for each
+		for _, aggregation := range Context.GetAggregationsForMetric(metr.Name) {
+			name := "ccloud_metric_" + GetNiceNameForMetric(metr) + GetAggregationSuffix(aggregation)
+			desc := prometheus.NewDesc(
+				name,
+				metr.Description,
+				labels,
+				nil,
+			)
+
+			metric := CCloudCollectorMetric{
+				name:           name,
+				metric:         metr,
+				desc:           desc,
+				counterDesc:    newCounterDesc(metr, name, labels),
+				duration:       requestDuration,
+				labels:         labels,
+				resourceLabels: resourceLabels,
+				aggregation:    aggregation,
+			}
+			collector.metrics[GetAggregatedMetricKey(metr.Name, aggregation)] = metric
 		}
-		collector.metrics[metr.Name] = metric
-	}
-
-	if len(mapOfWhiteListedMetrics) > 0 {
-		log.WithField("Ignored metrics", mapOfWhiteListedMetrics).Warnln("The following metrics will not be gathered as they are not exposed by the Metrics API")
 	}
 
-	return collector
+	return collector, nil
 }
@@ -0,0 +1,193 @@
+package collector
+
+//
+// collector_resource.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// ResourceCCloudCollector is a custom prometheus collector to collect data from
+// Confluent Cloud Metrics API. It fetches the metrics of one resource type
+// (e.g. connector, ksql, schema_registry) as returned by the resource descriptor
+type ResourceCCloudCollector struct {
+	metrics     map[string]CCloudCollectorMetric
+	descriptors []MetricDescription
+	rules       []Rule
+	ccloud      *CCloudCollector
+	resource    ResourceDescription
+}
+
+// Describe collect all metrics for ccloudexporter
+func (cc ResourceCCloudCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range cc.metrics {
+		ch <- desc.desc
+		if desc.counterDesc != nil {
+			ch <- desc.counterDesc
+		}
+		desc.duration.Describe(ch)
+	}
+}
+
+// Collect all metrics for Prometheus
+// to avoid reaching the scrape_timeout, metrics are fetched in multiple goroutine
+func (cc ResourceCCloudCollector) Collect(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup) {
+	for _, rule := range cc.rules {
+		cc.CollectRule(ctx, ch, wg, rule)
+	}
+}
+
+// CollectRule collects all metrics of a single rule, one goroutine is started per metric
+func (cc ResourceCCloudCollector) CollectRule(ctx context.Context, ch chan<- prometheus.Metric, wg *sync.WaitGroup, rule Rule) {
+	for _, metric := range rule.Metrics {
+		ccmetric, present := cc.metrics[GetAggregatedMetricKey(metric, rule.GetAggregation(metric))]
+		if !present {
+			continue
+		}
+
+		if len(rule.Resources[cc.resource.Type]) <= 0 {
+			log.WithFields(log.Fields{"rule": rule, "resourceType": cc.resource.Type}).Errorln("Rule has no resource ID specified for this resource type")
+			reportRuleError(ctx, rule, fmt.Errorf("no %s is specified", cc.resource.Type))
+			continue
+		}
+
+		wg.Add(1)
+		go cc.CollectMetricsForRule(ctx, wg, ch, rule, ccmetric)
+	}
+}
+
+// CollectMetricsForRule collects all metrics for a specific rule
+func (cc ResourceCCloudCollector) CollectMetricsForRule(ctx context.Context, wg *sync.WaitGroup, ch chan<- prometheus.Metric, rule Rule, ccmetric CCloudCollectorMetric) {
+	defer wg.Done()
+	query := BuildResourceQuery(ccmetric.metric, rule.Resources[cc.resource.Type], cc.resource)
+	query.Aggreations[0].Agg = ccmetric.aggregation
+	current := currentInterval(ctx)
+	setQueryInterval(ctx, &query, catchUpKey(rule, ccmetric), current)
+	log.WithFields(log.Fields{"query": query}).Traceln("The following query has been created")
+	optimizedQuery, additionalLabels := OptimizeQuery(query)
+	log.WithFields(log.Fields{"optimizedQuery": optimizedQuery, "additionalLabels": additionalLabels}).Traceln("Query has been optimized")
+	durationMetric, _ := ccmetric.duration.GetMetricWithLabelValues(strconv.Itoa(rule.id))
+	timer := prometheus.NewTimer(prometheus.ObserverFunc(durationMetric.Set))
+	response, err := SendQuery(ctx, optimizedQuery)
+	timer.ObserveDuration()
+	ch <- durationMetric
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"optimizedQuery": optimizedQuery, "response": response}).Errorln("Query did not succeed")
+		failedQueries.Inc()
+		reportRuleError(ctx, rule, fmt.Errorf("query of %s did not succeed: %s", ccmetric.metric.Name, err))
+		return
+	}
+	log.WithFields(log.Fields{"response": response}).Traceln("Response has been received")
+	cc.handleResponse(ctx, response, ccmetric, ch, rule, additionalLabels)
+	intervalTracker.Commit(catchUpKey(rule, ccmetric), current)
+}
+
+func (cc ResourceCCloudCollector) handleResponse(ctx context.Context, response QueryResponse, ccmetric CCloudCollectorMetric, ch chan<- prometheus.Metric, rule Rule, additionalLabels map[string]string) {
+	batch := NewDatapointBatch(ctx, ccmetric, rule)
+	defer batch.Send(ch)
+	for _, dataPoint := range response.Data {
+		value, ok := dataPoint["value"].(float64)
+		if !ok {
+			log.WithField("datapoint", dataPoint["value"]).Errorln("Can not convert result to float")
+			return
+		}
+
+		labels := []string{}
+		for _, label := range ccmetric.labels {
+			name := cc.resource.datapointFieldNameForLabel(label)
+			labelValue, labelValuePresent := dataPoint[name].(string)
+			if !labelValuePresent {
+				labelValue, labelValuePresent = additionalLabels[name]
+			}
+			labels = append(labels, labelValue)
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, fmt.Sprint(dataPoint["timestamp"]))
+		if err != nil {
+			log.WithError(err).Errorln("Can not parse timestamp, ignoring the response")
+			return
+		}
+		batch.Add(labels, value, timestamp)
+	}
+}
+
+// NewResourceCCloudCollector create a new Confluent Cloud collector for a resource type
+// The descriptor endpoint is only invoked if at least one rule targets this resource type
+func NewResourceCCloudCollector(ctx context.Context, ccloudcollecter *CCloudCollector, resource ResourceDescription) (ResourceCCloudCollector, error) {
+	collector := ResourceCCloudCollector{
+		rules:    Context.GetRulesForResource(resource.Type),
+		metrics:  make(map[string]CCloudCollectorMetric),
+		ccloud:   ccloudcollecter,
+		resource: resource,
+	}
+	if len(collector.rules) == 0 {
+		return collector, nil
+	}
+
+	descriptorResponse, err := SendDescriptorQuery(ctx, resource.Type)
+	if err != nil {
+		return collector, err
+	}
+	log.WithField("descriptor response", descriptorResponse).Traceln("The following response for the descriptor endpoint has been received")
+	collector.descriptors = descriptorResponse.Data
+	mapOfWhiteListedMetrics := Context.GetMapOfMetrics("")
+
+	for _, metr := range descriptorResponse.Data {
+		_, metricPresent := mapOfWhiteListedMetrics[metr.Name]
+		if !metricPresent {
+			continue
+		}
+		var labels []string
+		for _, metrLabel := range metr.Labels {
+			labels = append(labels, metrLabel.Key)
+		}
+
+		resourceLabels := make(map[string]string)
+		for _, rsrcLabel := range resource.Labels {
+			labels = append(labels, GetPrometheusNameForLabel(rsrcLabel.Key))
+			resourceLabels[GetPrometheusNameForLabel(rsrcLabel.Key)] = rsrcLabel.Key
+		}
+
+		requestDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "ccloud_metrics_api_request_latency",
+			Help:        "Metrics API request latency",
+			ConstLabels: map[string]string{"metric": metr.Name},
+		}, []string{"ruleNumber"})
+
+		// The same metric might be collected with different aggregations, one Prometheus metric is created for each
+		for _, aggregation := range Context.GetAggregationsForMetric(metr.Name) {
+			name := "ccloud_metric_" + resource.Type + "_" + GetNiceNameForMetric(metr) + GetAggregationSuffix(aggregation)
+			desc := prometheus.NewDesc(
+				name,
+				metr.Description,
+				labels,
+				nil,
+			)
+
+			metric := CCloudCollectorMetric{
+				name:           name,
+				metric:         metr,
+				desc:           desc,
+				counterDesc:    newCounterDesc(metr, name, labels),
+				duration:       requestDuration,
+				labels:         labels,
+				resourceLabels: resourceLabels,
+				aggregation:    aggregation,
+			}
+			collector.metrics[GetAggregatedMetricKey(metr.Name, aggregation)] = metric
+		}
+	}
+
+	return collector, nil
+}
@@ -0,0 +1,108 @@
+package collector
+
+//
+// collector_resource_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestResourceHandleResponse(t *testing.T) {
+	metric := CCloudCollectorMetric{
+		labels: []string{"schema_registry_id"},
+		metric: MetricDescription{Name: "io.confluent.kafka.schema_registry/schema_count"},
+		desc:   prometheus.NewDesc("ccloud_metric_schema_registry_schema_count", "help", []string{"schema_registry_id"}, nil),
+	}
+
+	collector := ResourceCCloudCollector{
+		metrics: map[string]CCloudCollectorMetric{
+			"io.confluent.kafka.schema_registry/schema_count": metric,
+		},
+		resource: ResourceDescription{
+			Type: "schema_registry",
+			Labels: []MetricLabel{
+				{
+					Key: "schema_registry.id",
+				},
+			},
+		},
+	}
+
+	rule := Rule{
+		id:        0,
+		Resources: map[string][]string{"schema_registry": {"lsrc-1", "lsrc-2"}},
+		Metrics:   []string{"io.confluent.kafka.schema_registry/schema_count"},
+	}
+
+	response := QueryResponse{}
+	err := json.Unmarshal([]byte(`
+{
+   "data": [
+			{
+					"resource.schema_registry.id": "lsrc-1",
+					"timestamp": "2020-06-03T13:37:00Z",
+					"value": 1.0
+			}
+	]
+}`), &response)
+	if err != nil {
+		t.Errorf(err.Error())
+		t.Fail()
+		return
+	}
+
+	pchan := make(chan prometheus.Metric, 10)
+	collector.handleResponse(context.Background(), response, metric, pchan, rule, make(map[string]string))
+
+	if len(pchan) != 1 {
+		t.Errorf("Invalid number of metrics returned, expected 1 got %d", len(pchan))
+		t.Fail()
+		return
+	}
+
+	result := dto.Metric{}
+	(<-pchan).Write(&result)
+	if result.Label[0].GetValue() != "lsrc-1" {
+		t.Errorf("Expected schema_registry_id to be lsrc-1, got %s", result.Label[0].GetValue())
+		t.Fail()
+	}
+}
+
+func TestBuildResourceQuery(t *testing.T) {
+	metric := MetricDescription{
+		Name: "io.confluent.flink/num_records_in",
+	}
+	resource := ResourceDescription{
+		Type: "compute_pool",
+		Labels: []MetricLabel{
+			{Key: "compute_pool.id"},
+			{Key: "flink_statement.name"},
+		},
+	}
+
+	query := BuildResourceQuery(metric, []string{"lfcp-1"}, resource)
+
+	if query.Filter.Filters[0].Filters[0].Field != "resource.compute_pool.id" {
+		t.Errorf("Unexpected filter: %+v", query.Filter)
+		t.Fail()
+	}
+
+	if len(query.GroupBy) != 2 || query.GroupBy[1] != "resource.flink_statement.name" {
+		t.Errorf("Unexpected groupBy list: %s", query.GroupBy)
+		t.Fail()
+	}
+
+	if GetNiceNameForMetric(metric) != "num_records_in" {
+		t.Errorf("Unexpected name for metric: %s", GetNiceNameForMetric(metric))
+		t.Fail()
+	}
+}
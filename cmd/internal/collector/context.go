@@ -7,32 +7,58 @@ package collector
 // Distributed under terms of the MIT license.
 //
 
-import "strings"
+import (
+	"strings"
+	"sync"
+	"time"
+)
 
 // ExporterContext define the global context for ccloudexporter
 // This global variables define all timeout, user configuration,
 // and cluster information
 type ExporterContext struct {
-	HTTPTimeout  int
-	HTTPBaseURL  string
-	Delay        int
-	CachedSecond int
-	Granularity  string
-	NoTimestamp  bool
-	Listener     string
-	Rules        []Rule
+	HTTPTimeout               int
+	HTTPBaseURL               string
+	MaxPages                  int
+	Retry                     RetryPolicy
+	MaxRequestsPerSecond      float64
+	MaxConcurrentRequests     int
+	ScrapeTimeout             int
+	Delay                     int
+	CachedSecond              int
+	StaleWhileRevalidate      bool
+	PollInterval              int
+	TopicRefreshInterval      int
+	AccumulateDeltas          bool
+	MaxCatchUp                int
+	Granularity               string
+	NoTimestamp               bool
+	FailFast                  bool
+	DescriptorRefreshInterval int
+	Discovery                 DiscoveryConfig
+	Sinks                     SinksConfig
+	Once                      bool
+	Pushgateway               PushgatewayConfig
+	Mode                      string
+	Listener                  string
+	Rules                     []Rule
 }
 
 // Rule defines one or multiple metrics that the exporter
 // should collect for a specific set of topics or clusters
 type Rule struct {
-	Topics                           []string `mapstructure:"topics"`
-	Clusters                         []string `mapstructure:"clusters"`
-	Connectors                       []string `mapstructure:"connectors"`
-	Ksql                             []string `mapstructure:"ksqls"`
-	SchemaRegistries                 []string `mapstructure:"schemaregistries"`
-	Metrics                          []string `mapstructure:"metrics"`
-	GroupByLabels                    []string `mapstructure:"labels"`
+	Topics                           []string            `mapstructure:"topics"`
+	TopicPatterns                    []string            `mapstructure:"topicPatterns"`
+	ExcludeTopics                    []string            `mapstructure:"excludeTopics"`
+	Clusters                         []string            `mapstructure:"clusters"`
+	Connectors                       []string            `mapstructure:"connectors"`
+	Ksql                             []string            `mapstructure:"ksqls"`
+	SchemaRegistries                 []string            `mapstructure:"schemaregistries"`
+	Resources                        map[string][]string `mapstructure:"resources"`
+	Discover                         bool                `mapstructure:"discover"`
+	Metrics                          []string            `mapstructure:"metrics"`
+	Aggregations                     map[string]string   `mapstructure:"aggregations"`
+	GroupByLabels                    []string            `mapstructure:"labels"`
 	cachedIgnoreGlobalResultForTopic map[TopicClusterMetric]bool
 	id                               int
 }
@@ -50,6 +76,9 @@ var Version = "homecooked"
 // Context is the global variable defining the context for the expoter
 var Context = ExporterContext{}
 
+// rulesMutex protects Context.Rules as rules can be replaced while metrics are collected
+var rulesMutex sync.RWMutex
+
 // DefaultGroupingLabels is the default value for groupBy.labels
 var DefaultGroupingLabels = []string{
 	"kafka.id",
@@ -57,6 +86,14 @@ var DefaultGroupingLabels = []string{
 	"type",
 }
 
+// DefaultRetryPolicy is the default value for config.http.retry
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseBackoff: time.Second,
+	MaxBackoff:  time.Second * 30,
+	Jitter:      0.2,
+}
+
 // DefaultMetrics is the default value for metrics
 var DefaultMetrics = []string{
 	"io.confluent.kafka.server/received_bytes",
@@ -77,12 +114,36 @@ var DefaultMetrics = []string{
 	"io.confluent.kafka.schema_registry/schema_count",
 }
 
+// GetRules returns the rules currently applied
+// Rules might be replaced at runtime, e.g. when new resources are discovered
+func (context *ExporterContext) GetRules() []Rule {
+	rulesMutex.RLock()
+	defer rulesMutex.RUnlock()
+	return context.Rules
+}
+
+// withRules returns a copy of the context applying other rules, e.g. to validate them before they are applied
+func (context *ExporterContext) withRules(rules []Rule) ExporterContext {
+	rulesMutex.RLock()
+	defer rulesMutex.RUnlock()
+	candidate := *context
+	candidate.Rules = rules
+	return candidate
+}
+
+// SetRules atomically replaces the rules currently applied
+func (context *ExporterContext) SetRules(rules []Rule) {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	context.Rules = rules
+}
+
 // GetMapOfMetrics returns the whitelist of metrics in a map
 // where the key is the metric and the value is true if it is comming from an override
-func (context ExporterContext) GetMapOfMetrics(prefix string) map[string]bool {
+func (context *ExporterContext) GetMapOfMetrics(prefix string) map[string]bool {
 	mapOfWhiteListedMetrics := make(map[string]bool)
 
-	for _, rule := range Context.Rules {
+	for _, rule := range Context.GetRules() {
 		for _, metric := range rule.Metrics {
 			if strings.HasPrefix(metric, prefix) {
 				mapOfWhiteListedMetrics[metric] = true
@@ -94,9 +155,9 @@ func (context ExporterContext) GetMapOfMetrics(prefix string) map[string]bool {
 }
 
 // GetMetrics return the list of all metrics exposed in any rule
-func (context ExporterContext) GetMetrics() []string {
+func (context *ExporterContext) GetMetrics() []string {
 	metrics := make([]string, 0)
-	for _, rule := range Context.Rules {
+	for _, rule := range Context.GetRules() {
 		for _, metric := range rule.Metrics {
 			if !contains(metrics, metric) {
 				metrics = append(metrics, metric)
@@ -107,10 +168,23 @@ func (context ExporterContext) GetMetrics() []string {
 	return metrics
 }
 
+// GetAggregationsForMetric returns the aggregations used by the rules collecting this metric
+// An empty string stands for the default aggregation of the Metrics API
+func (context *ExporterContext) GetAggregationsForMetric(metric string) []string {
+	aggregations := make([]string, 0)
+	for _, rule := range Context.GetRules() {
+		aggregation := rule.GetAggregation(metric)
+		if contains(rule.Metrics, metric) && !contains(aggregations, aggregation) {
+			aggregations = append(aggregations, aggregation)
+		}
+	}
+	return aggregations
+}
+
 // GetKafkaRules return all rules associated to a Kafka cluster
-func (context ExporterContext) GetKafkaRules() []Rule {
+func (context *ExporterContext) GetKafkaRules() []Rule {
 	kafkaRules := make([]Rule, 0)
-	for _, irule := range Context.Rules {
+	for _, irule := range Context.GetRules() {
 		if len(irule.Clusters) > 0 {
 			kafkaRules = append(kafkaRules, irule)
 		}
@@ -119,40 +193,16 @@ func (context ExporterContext) GetKafkaRules() []Rule {
 	return kafkaRules
 }
 
-// GetConnectorRules return all rules associated to at least one connector
-func (context ExporterContext) GetConnectorRules() []Rule {
-	connectorRule := make([]Rule, 0)
-	for _, irule := range Context.Rules {
-		if len(irule.Connectors) > 0 {
-			connectorRule = append(connectorRule, irule)
-		}
-	}
-
-	return connectorRule
-}
-
-// GetKsqlRules return all rules associated to at least one ksql application
-func (context ExporterContext) GetKsqlRules() []Rule {
-	ksqlRules := make([]Rule, 0)
-	for _, irule := range Context.Rules {
-		if len(irule.Ksql) > 0 {
-			ksqlRules = append(ksqlRules, irule)
-		}
-	}
-
-	return ksqlRules
-}
-
-// GetSchemaRegistryRules return all rules associated to at least one Schema Registry instance
-func (context ExporterContext) GetSchemaRegistryRules() []Rule {
-	schemaRegistryRules := make([]Rule, 0)
-	for _, irule := range Context.Rules {
-		if len(irule.SchemaRegistries) > 0 {
-			schemaRegistryRules = append(schemaRegistryRules, irule)
+// GetRulesForResource return all rules associated to at least one resource of this type
+func (context *ExporterContext) GetRulesForResource(resourceType string) []Rule {
+	resourceRules := make([]Rule, 0)
+	for _, irule := range Context.GetRules() {
+		if len(irule.Resources[resourceType]) > 0 {
+			resourceRules = append(resourceRules, irule)
 		}
 	}
 
-	return schemaRegistryRules
+	return resourceRules
 }
 
 // ShouldIgnoreResultForRule returns true if the result for this topic need to be ignored for this rule.
@@ -167,12 +217,12 @@ func (rule Rule) ShouldIgnoreResultForRule(topic string, cluster string, metric
 	if present {
 		return result
 	}
-	for _, irule := range Context.Rules {
+	for _, irule := range Context.GetRules() {
 		if irule.id == rule.id {
 			continue
 		}
 		if contains(irule.Metrics, metric) && contains(irule.Clusters, cluster) {
-			if len(rule.Topics) == 0 && len(irule.Topics) > 0 && contains(irule.Topics, topic) {
+			if !rule.selectsTopics() && irule.selectsTopics() && irule.MatchesTopic(topic) {
 				rule.cachedIgnoreGlobalResultForTopic[TopicClusterMetric{topic, cluster, metric}] = true
 				return true
 			}
@@ -182,3 +232,19 @@ func (rule Rule) ShouldIgnoreResultForRule(topic string, cluster string, metric
 	rule.cachedIgnoreGlobalResultForTopic[TopicClusterMetric{topic, cluster, metric}] = false
 	return false
 }
+
+// hasResources returns true if the rule targets at least one resource, other than a Kafka cluster
+func (rule Rule) hasResources() bool {
+	for _, ids := range rule.Resources {
+		if len(ids) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAggregation returns the aggregation of a metric collected by the rule
+// An empty string stands for the default aggregation of the Metrics API
+func (rule Rule) GetAggregation(metric string) string {
+	return rule.Aggregations[metric]
+}
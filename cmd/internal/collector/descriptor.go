@@ -8,8 +8,11 @@ package collector
 //
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"net/http"
+	"sort"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -43,6 +46,15 @@ type MetricLabel struct {
 	Description string `json:"description"`
 }
 
+// DescriptorDiff lists the changes between two sets of metric descriptors
+// Labels are reported as <metric name>:<label key>
+type DescriptorDiff struct {
+	AddedMetrics   []string
+	RemovedMetrics []string
+	AddedLabels    []string
+	RemovedLabels  []string
+}
+
 // DescriptorResourceResponse is the result of the Metrics API resource description
 type DescriptorResourceResponse struct {
 	Data []ResourceDescription `json:"data"`
@@ -67,6 +79,45 @@ var (
 	descriptorResourceURI = "v2/metrics/cloud/descriptors/resources"
 )
 
+// IsEmpty returns true if the descriptors have not changed
+func (diff DescriptorDiff) IsEmpty() bool {
+	return len(diff.AddedMetrics) == 0 && len(diff.RemovedMetrics) == 0 && len(diff.AddedLabels) == 0 && len(diff.RemovedLabels) == 0
+}
+
+// DiffDescriptors returns the metrics and labels that have been added or removed between previous and current
+func DiffDescriptors(previous map[string]MetricDescription, current map[string]MetricDescription) DescriptorDiff {
+	diff := DescriptorDiff{}
+	for name, metric := range current {
+		previousMetric, present := previous[name]
+		if !present {
+			diff.AddedMetrics = append(diff.AddedMetrics, name)
+			continue
+		}
+		for _, label := range metric.Labels {
+			if !previousMetric.hasLabel(label.Key) {
+				diff.AddedLabels = append(diff.AddedLabels, name+":"+label.Key)
+			}
+		}
+		for _, label := range previousMetric.Labels {
+			if !metric.hasLabel(label.Key) {
+				diff.RemovedLabels = append(diff.RemovedLabels, name+":"+label.Key)
+			}
+		}
+	}
+
+	for name := range previous {
+		if _, present := current[name]; !present {
+			diff.RemovedMetrics = append(diff.RemovedMetrics, name)
+		}
+	}
+
+	sort.Strings(diff.AddedMetrics)
+	sort.Strings(diff.RemovedMetrics)
+	sort.Strings(diff.AddedLabels)
+	sort.Strings(diff.RemovedLabels)
+	return diff
+}
+
 // Return true if the metric has this label
 func (metric MetricDescription) hasLabel(label string) bool {
 	for _, l := range metric.Labels {
@@ -79,21 +130,38 @@ func (metric MetricDescription) hasLabel(label string) bool {
 
 // Return true if the resource has this label
 func (resource ResourceDescription) hasLabel(label string) bool {
+	_, present := resource.labelKey(label)
+	return present
+}
+
+// labelKey returns the key of the resource label matching label
+// label could either be the key itself (e.g. schema_registry.id) or
+// its Prometheus name (e.g. schema_registry_id)
+func (resource ResourceDescription) labelKey(label string) (string, bool) {
 	stripLabel := strings.Replace(strings.Replace(label, "resource.", "", 1), ".", "_", -1)
 	for _, l := range resource.Labels {
 		stripKey := strings.Replace(strings.Replace(l.Key, "resource.", "", 1), ".", "_", -1)
 		if stripKey == stripLabel {
-			return true
+			return l.Key, true
 		}
 	}
-	return false
+	return "", false
+}
+
+// idLabel returns the key of the label identifying a resource, e.g. connector.id
+func (resource ResourceDescription) idLabel() string {
+	if resource.hasLabel(resource.Type + ".id") {
+		return resource.Type + ".id"
+	}
+	if len(resource.Labels) > 0 {
+		return resource.Labels[0].Key
+	}
+	return resource.Type + ".id"
 }
 
 func (resource ResourceDescription) datapointFieldNameForLabel(label string) string {
-	if resource.hasLabel(label) {
-		return "resource." + strings.Replace(label, "_", ".", -1)
-		// TODO fix it to work with schema_registry_id in param. Must return resource.schema_registry.id
-		// When fix, could remove hard coded conversion in collector_schemaregistry.go line 91->93
+	if key, present := resource.labelKey(label); present {
+		return "resource." + key
 	}
 	return "metric." + label
 }
@@ -101,9 +169,10 @@ func (resource ResourceDescription) datapointFieldNameForLabel(label string) str
 // GetNiceNameForMetric returns a human friendly metric name from a Confluent Cloud API metric
 func GetNiceNameForMetric(metric MetricDescription) string {
 	splits := strings.Split(metric.Name, "/")
-	for _, split := range splits {
+	for i, split := range splits {
 		_, contain := excludeListForMetric[split]
-		if !contain {
+		// The first part of the name is the dataset of the metric (e.g. io.confluent.kafka.server)
+		if !contain && (i > 0 || len(splits) == 1) {
 			return split
 		}
 	}
@@ -119,54 +188,37 @@ func GetPrometheusNameForLabel(label string) string {
 
 // SendDescriptorQuery calls the https://api.telemetry.confluent.cloud/v2/metrics/cloud/descriptors endpoint
 // to retrieve the list of metrics
-func SendDescriptorQuery(ressourceType string) DescriptorMetricResponse {
+func SendDescriptorQuery(ctx context.Context, ressourceType string) (DescriptorMetricResponse, error) {
 	endpoint := Context.HTTPBaseURL + descriptorURI + "?resource_type=" + ressourceType
-	req := MustGetNewRequest("GET", endpoint, nil)
-
-	res, err := httpClient.Do(req)
-	if err != nil {
-		log.WithError(err).Fatalln("HTTP query for the descriptor endpoint failed")
-	}
-
-	if res.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(res.Body)
-		log.WithFields(log.Fields{"StatusCode": res.StatusCode, "Endpoint": endpoint, "body": body}).Fatalf("Received status code %d instead of 200 for GET on %s. \n\n%s\n\n", res.StatusCode, endpoint, body)
-	}
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.WithError(err).Fatalln("Can not read the content of the descriptor query")
-	}
-
 	response := DescriptorMetricResponse{}
-	json.Unmarshal(body, &response)
-
-	return response
+	err := sendDescriptorRequest(ctx, endpoint, &response)
+	return response, err
 }
 
 // SendResourceDescriptorQuery calls the https://api.telemetry.confluent.cloud/v2/metrics/cloud/descriptors endpoint
 // to retrieve the list of available resources
-func SendResourceDescriptorQuery() DescriptorResourceResponse {
+func SendResourceDescriptorQuery(ctx context.Context) (DescriptorResourceResponse, error) {
 	endpoint := Context.HTTPBaseURL + descriptorResourceURI
-	req := MustGetNewRequest("GET", endpoint, nil)
+	response := DescriptorResourceResponse{}
+	err := sendDescriptorRequest(ctx, endpoint, &response)
+	return response, err
+}
 
-	res, err := httpClient.Do(req)
+func sendDescriptorRequest(ctx context.Context, endpoint string, response interface{}) error {
+	res, body, err := SendWithRetry(ctx, func() (*http.Request, error) {
+		return NewRequest("GET", endpoint, nil)
+	})
 	if err != nil {
-		log.WithError(err).Fatalln("HTTP query for the descriptor endpoint failed")
+		return fmt.Errorf("HTTP query for the descriptor endpoint %s failed: %s", endpoint, err)
 	}
 
 	if res.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(res.Body)
-		log.WithFields(log.Fields{"StatusCode": res.StatusCode, "Endpoint": endpoint, "body": body}).Fatalf("Received status code %d instead of 200 for GET on %s. \n\n%s\n\n", res.StatusCode, endpoint, body)
+		return fmt.Errorf("received status code %d instead of 200 for GET on %s (%s)", res.StatusCode, endpoint, body)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	err = json.Unmarshal(body, response)
 	if err != nil {
-		log.WithError(err).Fatalln("Can not read the content of the descriptor query")
+		return fmt.Errorf("can not decode the response of the descriptor endpoint %s: %s", endpoint, err)
 	}
-
-	response := DescriptorResourceResponse{}
-	json.Unmarshal(body, &response)
-
-	return response
+	return nil
 }
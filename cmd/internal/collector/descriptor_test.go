@@ -7,7 +7,13 @@ package collector
 // Distributed under terms of the MIT license.
 //
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
 
 func TestGetNiceNameForMetric(t *testing.T) {
 	metric := MetricDescription{
@@ -42,3 +48,58 @@ func TestHasLabel(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDescriptorQueryReturnsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", Retry: RetryPolicy{MaxAttempts: 1}}
+
+	_, err := SendResourceDescriptorQuery(context.Background())
+	if err == nil {
+		t.Errorf("Expected an error while the descriptor endpoint is unavailable")
+		t.Fail()
+	}
+}
+
+func TestDiffDescriptors(t *testing.T) {
+	previous := map[string]MetricDescription{
+		"metric1": {Name: "metric1", Labels: []MetricLabel{{Key: "topic"}, {Key: "partition"}}},
+		"metric2": {Name: "metric2"},
+	}
+	current := map[string]MetricDescription{
+		"metric1": {Name: "metric1", Labels: []MetricLabel{{Key: "topic"}, {Key: "principal_id"}}},
+		"metric3": {Name: "metric3"},
+	}
+
+	diff := DiffDescriptors(previous, current)
+
+	if len(diff.AddedMetrics) != 1 || diff.AddedMetrics[0] != "metric3" {
+		t.Errorf("Unexpected added metrics: %s", diff.AddedMetrics)
+		t.Fail()
+	}
+
+	if len(diff.RemovedMetrics) != 1 || diff.RemovedMetrics[0] != "metric2" {
+		t.Errorf("Unexpected removed metrics: %s", diff.RemovedMetrics)
+		t.Fail()
+	}
+
+	if len(diff.AddedLabels) != 1 || diff.AddedLabels[0] != "metric1:principal_id" {
+		t.Errorf("Unexpected added labels: %s", diff.AddedLabels)
+		t.Fail()
+	}
+
+	if len(diff.RemovedLabels) != 1 || diff.RemovedLabels[0] != "metric1:partition" {
+		t.Errorf("Unexpected removed labels: %s", diff.RemovedLabels)
+		t.Fail()
+	}
+
+	if !DiffDescriptors(current, current).IsEmpty() {
+		t.Errorf("Expected no difference between identical descriptors")
+		t.Fail()
+	}
+}
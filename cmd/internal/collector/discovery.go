@@ -0,0 +1,317 @@
+package collector
+
+//
+// discovery.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DiscoveryConfig defines how resources are discovered from the Confluent Cloud REST APIs
+type DiscoveryConfig struct {
+	BaseURL      string   `mapstructure:"baseUrl"`
+	Interval     int      `mapstructure:"interval"`
+	Environments []string `mapstructure:"environments"`
+	NameRegex    string   `mapstructure:"nameRegex"`
+}
+
+// DiscoveredResources are the IDs of the resources discovered in the organization
+type DiscoveredResources struct {
+	Clusters  []string
+	Resources map[string][]string
+}
+
+// discoveryListResponse is the common structure of the list endpoints
+// of the Confluent Cloud REST APIs (environments, clusters, ...)
+type discoveryListResponse struct {
+	Data []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"display_name"`
+		Spec        struct {
+			DisplayName string `json:"display_name"`
+		} `json:"spec"`
+	} `json:"data"`
+	Metadata struct {
+		Next string `json:"next"`
+	} `json:"metadata"`
+}
+
+// discoveredItem is one resource returned by a list endpoint
+type discoveredItem struct {
+	ID   string
+	Name string
+}
+
+// connectorListResponse is the response of the connectors list endpoint with ?expand=id
+type connectorListResponse map[string]struct {
+	ID struct {
+		ID string `json:"id"`
+	} `json:"id"`
+}
+
+var (
+	environmentsURI   = "org/v2/environments"
+	clustersURI       = "cmk/v2/clusters"
+	ksqlClustersURI   = "ksqldbcm/v2/clusters"
+	schemaRegistryURI = "srcm/v2/clusters"
+	connectorsURI     = "connect/v1/environments/%s/clusters/%s/connectors?expand=id"
+
+	// configuredRules are the rules as defined by the user, before discovered resources are injected
+	configuredRules []Rule
+	// discoveredResources are the resources found by the last successful discovery
+	discoveredResources DiscoveredResources
+	// discoveryMutex protects configuredRules and discoveredResources
+	discoveryMutex sync.Mutex
+)
+
+// DefaultDiscoveryConfig is the default value for config.discovery
+var DefaultDiscoveryConfig = DiscoveryConfig{
+	BaseURL:  "https://api.confluent.cloud/",
+	Interval: 300,
+}
+
+// IsDiscoveryEnabled returns true if at least one rule relies on discovered resources
+func IsDiscoveryEnabled(rules []Rule) bool {
+	for _, rule := range rules {
+		if rule.Discover {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverResources lists the Kafka clusters, connectors, ksqlDB applications and
+// Schema Registries of the organization, filtered by environment and name
+func DiscoverResources(ctx context.Context) (DiscoveredResources, error) {
+	discovered := DiscoveredResources{
+		Clusters:  []string{},
+		Resources: map[string][]string{"connector": {}, "ksql": {}, "schema_registry": {}},
+	}
+
+	var nameRegex *regexp.Regexp
+	if Context.Discovery.NameRegex != "" {
+		var err error
+		nameRegex, err = regexp.Compile(Context.Discovery.NameRegex)
+		if err != nil {
+			return discovered, fmt.Errorf("invalid config.discovery.nameRegex: %s", err)
+		}
+	}
+	matches := func(item discoveredItem) bool {
+		return nameRegex == nil || nameRegex.MatchString(item.Name)
+	}
+
+	environments := Context.Discovery.Environments
+	if len(environments) == 0 {
+		items, err := listDiscoveryItems(ctx, environmentsURI)
+		if err != nil {
+			return discovered, err
+		}
+		for _, item := range items {
+			environments = append(environments, item.ID)
+		}
+	}
+
+	for _, environment := range environments {
+		environmentFilter := "?environment=" + url.QueryEscape(environment)
+
+		clusters, err := listDiscoveryItems(ctx, clustersURI+environmentFilter)
+		if err != nil {
+			return discovered, err
+		}
+		for _, cluster := range clusters {
+			if matches(cluster) {
+				discovered.Clusters = append(discovered.Clusters, cluster.ID)
+			}
+
+			// Connectors are filtered on their own name, not the name of their cluster
+			connectors, err := listConnectors(ctx, environment, cluster.ID)
+			if err != nil {
+				return discovered, err
+			}
+			for _, connector := range connectors {
+				if matches(connector) {
+					discovered.Resources["connector"] = append(discovered.Resources["connector"], connector.ID)
+				}
+			}
+		}
+
+		ksqlApplications, err := listDiscoveryItems(ctx, ksqlClustersURI+environmentFilter)
+		if err != nil {
+			return discovered, err
+		}
+		for _, ksqlApplication := range ksqlApplications {
+			if matches(ksqlApplication) {
+				discovered.Resources["ksql"] = append(discovered.Resources["ksql"], ksqlApplication.ID)
+			}
+		}
+
+		schemaRegistries, err := listDiscoveryItems(ctx, schemaRegistryURI+environmentFilter)
+		if err != nil {
+			return discovered, err
+		}
+		for _, schemaRegistry := range schemaRegistries {
+			if matches(schemaRegistry) {
+				discovered.Resources["schema_registry"] = append(discovered.Resources["schema_registry"], schemaRegistry.ID)
+			}
+		}
+	}
+
+	sort.Strings(discovered.Clusters)
+	for _, ids := range discovered.Resources {
+		sort.Strings(ids)
+	}
+	return discovered, nil
+}
+
+// listDiscoveryItems calls a list endpoint of the Confluent Cloud REST APIs and follows its pagination
+func listDiscoveryItems(ctx context.Context, uri string) ([]discoveredItem, error) {
+	items := make([]discoveredItem, 0)
+	endpoint := Context.Discovery.BaseURL + uri
+	for endpoint != "" {
+		response := discoveryListResponse{}
+		err := sendDiscoveryRequest(ctx, endpoint, &response)
+		if err != nil {
+			return items, err
+		}
+
+		for _, data := range response.Data {
+			name := data.Spec.DisplayName
+			if name == "" {
+				name = data.DisplayName
+			}
+			items = append(items, discoveredItem{ID: data.ID, Name: name})
+		}
+		endpoint = response.Metadata.Next
+	}
+	return items, nil
+}
+
+func listConnectors(ctx context.Context, environment string, cluster string) ([]discoveredItem, error) {
+	endpoint := Context.Discovery.BaseURL + fmt.Sprintf(connectorsURI, url.PathEscape(environment), url.PathEscape(cluster))
+	response := connectorListResponse{}
+	err := sendDiscoveryRequest(ctx, endpoint, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]discoveredItem, 0, len(response))
+	for name, connector := range response {
+		items = append(items, discoveredItem{ID: connector.ID.ID, Name: name})
+	}
+	return items, nil
+}
+
+// sendDiscoveryRequest sends a request to the Confluent Cloud API
+// The Confluent Cloud API is not part of the Metrics API, thus discovery requests do not consume its rate limit
+func sendDiscoveryRequest(ctx context.Context, endpoint string, response interface{}) error {
+	res, body, err := sendWithRetry(ctx, &httpClient, Context.Retry, nil, func() (*http.Request, error) {
+		return NewRequest("GET", endpoint, nil)
+	})
+	if err != nil {
+		return fmt.Errorf("HTTP query for the discovery endpoint %s failed: %s", endpoint, err)
+	}
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("received status code %d instead of 200 for GET on %s (%s)", res.StatusCode, endpoint, body)
+	}
+
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return fmt.Errorf("can not decode the response of the discovery endpoint %s: %s", endpoint, err)
+	}
+	return nil
+}
+
+// ApplyDiscoveredResources returns a copy of the rules where the discovered resources
+// are added to every rule marked with discover: true
+func ApplyDiscoveredResources(rules []Rule, discovered DiscoveredResources) []Rule {
+	appliedRules := make([]Rule, len(rules))
+	for i, rule := range rules {
+		if !rule.Discover {
+			appliedRules[i] = rule
+			continue
+		}
+
+		rule.Clusters = mergeIDs(rule.Clusters, discovered.Clusters)
+		resources := make(map[string][]string)
+		for resourceType, ids := range rule.Resources {
+			resources[resourceType] = ids
+		}
+		for resourceType, ids := range discovered.Resources {
+			resources[resourceType] = mergeIDs(resources[resourceType], ids)
+		}
+		rule.Resources = resources
+		appliedRules[i] = rule
+	}
+	return appliedRules
+}
+
+func mergeIDs(configured []string, discovered []string) []string {
+	merged := append([]string{}, configured...)
+	for _, id := range discovered {
+		if !contains(merged, id) {
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// refreshDiscoveredResources discovers the resources of the organization and applies them to the rules
+// It returns true if the resources have changed since the previous discovery
+func refreshDiscoveredResources() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Context.ScrapeTimeout))
+	defer cancel()
+
+	discovered, err := DiscoverResources(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	if reflect.DeepEqual(discovered, discoveredResources) {
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{
+		"clusters":         strings.Join(discovered.Clusters, ","),
+		"connectors":       strings.Join(discovered.Resources["connector"], ","),
+		"ksqls":            strings.Join(discovered.Resources["ksql"], ","),
+		"schemaRegistries": strings.Join(discovered.Resources["schema_registry"], ","),
+	}).Infoln("Resources have been discovered")
+	discoveredResources = discovered
+	Context.SetRules(ApplyDiscoveredResources(configuredRules, discoveredResources))
+	return true, nil
+}
+
+// setConfiguredRules replaces the rules defined by the user
+// Previously discovered resources are applied to the new rules
+func setConfiguredRules(rules []Rule) {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	configuredRules = rules
+	Context.SetRules(ApplyDiscoveredResources(configuredRules, discoveredResources))
+}
+
+// isDiscoveryConfigured returns true if at least one rule defined by the user relies on discovered resources
+func isDiscoveryConfigured() bool {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	return IsDiscoveryEnabled(configuredRules)
+}
@@ -0,0 +1,141 @@
+package collector
+
+//
+// discovery_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiscoverResources(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/org/v2/environments":
+			if r.URL.Query().Get("page_token") == "" {
+				fmt.Fprintf(w, `{"data":[{"id":"env-1"}],"metadata":{"next":"%s/org/v2/environments?page_token=next"}}`, server.URL)
+			} else {
+				fmt.Fprint(w, `{"data":[{"id":"env-2"}],"metadata":{}}`)
+			}
+		case "/cmk/v2/clusters":
+			environment := r.URL.Query().Get("environment")
+			fmt.Fprintf(w, `{"data":[{"id":"lkc-%s","spec":{"display_name":"prod-%s"}},{"id":"lkc-dev-%s","spec":{"display_name":"dev-%s"}}]}`, environment, environment, environment, environment)
+		case "/connect/v1/environments/env-1/clusters/lkc-env-1/connectors":
+			fmt.Fprint(w, `{"prod-sink":{"id":{"id":"lcc-1"}},"dev-sink":{"id":{"id":"lcc-2"}}}`)
+		case "/ksqldbcm/v2/clusters":
+			if r.URL.Query().Get("environment") == "env-1" {
+				fmt.Fprint(w, `{"data":[{"id":"lksqlc-1","spec":{"display_name":"prod-ksql"}}]}`)
+			} else {
+				fmt.Fprint(w, `{"data":[]}`)
+			}
+		case "/srcm/v2/clusters":
+			if r.URL.Query().Get("environment") == "env-2" {
+				fmt.Fprint(w, `{"data":[{"id":"lsrc-1","spec":{"display_name":"prod-sr"}}]}`)
+			} else {
+				fmt.Fprint(w, `{"data":[]}`)
+			}
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{
+		Retry:     RetryPolicy{MaxAttempts: 1},
+		Discovery: DiscoveryConfig{BaseURL: server.URL + "/", NameRegex: "^prod-"},
+	}
+
+	discovered, err := DiscoverResources(context.Background())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := DiscoveredResources{
+		Clusters: []string{"lkc-env-1", "lkc-env-2"},
+		Resources: map[string][]string{
+			"connector":       {"lcc-1"},
+			"ksql":            {"lksqlc-1"},
+			"schema_registry": {"lsrc-1"},
+		},
+	}
+	if !reflect.DeepEqual(discovered, expected) {
+		t.Errorf("Unexpected discovered resources: %+v", discovered)
+		t.Fail()
+	}
+}
+
+func TestApplyDiscoveredResources(t *testing.T) {
+	rules := []Rule{
+		{Clusters: []string{"lkc-static"}, Discover: false},
+		{Clusters: []string{"lkc-1"}, Resources: map[string][]string{"connector": {"lcc-static"}}, Discover: true},
+	}
+	discovered := DiscoveredResources{
+		Clusters:  []string{"lkc-1", "lkc-2"},
+		Resources: map[string][]string{"connector": {"lcc-1"}},
+	}
+
+	applied := ApplyDiscoveredResources(rules, discovered)
+
+	if !reflect.DeepEqual(applied[0], rules[0]) {
+		t.Errorf("Rules without discover should not be modified: %+v", applied[0])
+		t.Fail()
+	}
+
+	if !reflect.DeepEqual(applied[1].Clusters, []string{"lkc-1", "lkc-2"}) {
+		t.Errorf("Unexpected clusters: %s", applied[1].Clusters)
+		t.Fail()
+	}
+
+	if !reflect.DeepEqual(applied[1].Resources["connector"], []string{"lcc-static", "lcc-1"}) {
+		t.Errorf("Unexpected connectors: %s", applied[1].Resources["connector"])
+		t.Fail()
+	}
+
+	if len(rules[1].Clusters) != 1 || len(rules[1].Resources["connector"]) != 1 {
+		t.Errorf("Configured rules should not be modified: %+v", rules[1])
+		t.Fail()
+	}
+}
+
+func TestDiscoveryDoesNotConsumeMetricsAPILimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[]}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{
+		Retry:     RetryPolicy{MaxAttempts: 1},
+		Discovery: DiscoveryConfig{BaseURL: server.URL + "/"},
+	}
+
+	// The only request allowed by the limiter of the Metrics API is in flight
+	limiter = NewRequestLimiter(0, 1)
+	release, _ := limiter.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := DiscoverResources(ctx)
+	if err != nil {
+		t.Errorf("Expected the discovery not to wait for the limiter of the Metrics API: %s", err)
+		t.Fail()
+	}
+	limiter = NewRequestLimiter(0, 0)
+}
@@ -0,0 +1,193 @@
+package collector
+
+//
+// dogstatsd.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DogStatsDConfig configures the DogStatsD sink
+type DogStatsDConfig struct {
+	// Address is either host:port, udp://host:port or unix:///path/to/dsd.socket
+	Address string
+	Prefix  string
+	Tags    []string
+	// Samples is either latest, to only send the latest data point of each series, or timestamped
+	Samples       string
+	MaxPacketSize int
+}
+
+// DefaultDogStatsDConfig is the default configuration of the DogStatsD sink
+var DefaultDogStatsDConfig = DogStatsDConfig{
+	Prefix:        "ccloud.",
+	Samples:       "latest",
+	MaxPacketSize: 1432,
+}
+
+// DogStatsDSink sends each data point as a gauge to a DogStatsD server, e.g. the Datadog Agent
+// The labels of the data points are converted to tags
+type DogStatsDSink struct {
+	config DogStatsDConfig
+	// connMutex protects conn, the connection is re-established after a failed write
+	connMutex sync.Mutex
+	conn      net.Conn
+	sinkBuffer
+}
+
+// tagReplacer removes the characters that delimit the fields of a DogStatsD datagram from the tags
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "\n", "_", " ", "_")
+
+// check returns an error describing the first invalid option of the DogStatsD sink
+func (config DogStatsDConfig) check() error {
+	network, address := config.network()
+	if network == "udp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("config.sinks.dogstatsd.address is not a valid address: %s", err)
+		}
+	}
+
+	if config.Samples != "latest" && config.Samples != "timestamped" {
+		return fmt.Errorf("config.sinks.dogstatsd.samples %s is invalid, supported values are latest and timestamped", config.Samples)
+	}
+
+	if config.MaxPacketSize <= 0 {
+		return errors.New("config.sinks.dogstatsd.maxPacketSize must be positive")
+	}
+	return nil
+}
+
+// network returns the network and the address to dial, unix sockets are datagram sockets
+func (config DogStatsDConfig) network() (string, string) {
+	if strings.HasPrefix(config.Address, "unix://") {
+		return "unixgram", strings.TrimPrefix(config.Address, "unix://")
+	}
+	return "udp", strings.TrimPrefix(config.Address, "udp://")
+}
+
+// NewDogStatsDSink creates a new DogStatsD sink, the connection is established on the first flush
+func NewDogStatsDSink(config DogStatsDConfig) *DogStatsDSink {
+	return &DogStatsDSink{config: config}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *DogStatsDSink) Name() string {
+	return "dogstatsd"
+}
+
+// Flush sends the buffered data points, packed in datagrams of at most config.sinks.dogstatsd.maxPacketSize bytes
+func (sink *DogStatsDSink) Flush() error {
+	// All data points are handled at once, as only the latest data point of each series may be sent
+	return sink.flush(sink.Name(), math.MaxInt32, sink.send)
+}
+
+// send sends data points, a datagram that can not be written is dropped and the connection is re-established
+func (sink *DogStatsDSink) send(points []Datapoint) error {
+	if sink.config.Samples == "latest" {
+		points = latestDatapoints(points)
+	}
+
+	sink.connMutex.Lock()
+	defer sink.connMutex.Unlock()
+	if sink.conn == nil {
+		network, address := sink.config.network()
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return fmt.Errorf("can not connect to DogStatsD at %s: %s", sink.config.Address, err)
+		}
+		sink.conn = conn
+	}
+
+	var packet []byte
+	var lastErr error
+	for _, point := range points {
+		line := sink.format(point)
+		if len(packet) > 0 && len(packet)+1+len(line) > sink.config.MaxPacketSize {
+			lastErr = sink.writePacket(packet, lastErr)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		lastErr = sink.writePacket(packet, lastErr)
+	}
+	log.WithFields(log.Fields{"dataPoints": len(points), "address": sink.config.Address}).Debugln("Data points have been sent to DogStatsD")
+	return lastErr
+}
+
+// writePacket writes a single datagram, the connection is closed if the write fails
+func (sink *DogStatsDSink) writePacket(packet []byte, lastErr error) error {
+	if sink.conn == nil {
+		return lastErr
+	}
+	_, err := sink.conn.Write(packet)
+	if err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return fmt.Errorf("can not send data points to DogStatsD at %s: %s", sink.config.Address, err)
+	}
+	return lastErr
+}
+
+// format returns the DogStatsD datagram of a data point, e.g.
+//
+//	ccloud.received_bytes:42|g|#kafka_id:lkc-1,topic:orders
+func (sink *DogStatsDSink) format(point Datapoint) string {
+	var builder strings.Builder
+	builder.WriteString(sink.config.Prefix)
+	builder.WriteString(strings.TrimPrefix(point.Name, "ccloud_metric_"))
+	builder.WriteString(":")
+	builder.WriteString(strconv.FormatFloat(point.Value, 'f', -1, 64))
+	builder.WriteString("|g")
+
+	tags := make([]string, 0, len(sink.config.Tags)+len(point.Labels))
+	tags = append(tags, sink.config.Tags...)
+	for name, value := range point.Labels {
+		tags = append(tags, tagReplacer.Replace(name+":"+value))
+	}
+	sort.Strings(tags[len(sink.config.Tags):])
+	if len(tags) > 0 {
+		builder.WriteString("|#")
+		builder.WriteString(strings.Join(tags, ","))
+	}
+
+	// Timestamps are supported by the Datadog Agent since 7.40
+	if sink.config.Samples == "timestamped" && !point.Timestamp.IsZero() {
+		builder.WriteString("|T")
+		builder.WriteString(strconv.FormatInt(point.Timestamp.Unix(), 10))
+	}
+	return builder.String()
+}
+
+// latestDatapoints returns the latest data point of each series, in the order of their first occurrence
+func latestDatapoints(points []Datapoint) []Datapoint {
+	indexes := make(map[string]int)
+	result := make([]Datapoint, 0, len(points))
+	for _, point := range points {
+		key := seriesKey(point)
+		index, present := indexes[key]
+		if !present {
+			indexes[key] = len(result)
+			result = append(result, point)
+		} else if point.Timestamp.After(result[index].Timestamp) {
+			result[index] = point
+		}
+	}
+	return result
+}
@@ -0,0 +1,79 @@
+package collector
+
+//
+// dogstatsd_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDogStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Can not listen: %s", err)
+		t.Fail()
+		return
+	}
+	defer conn.Close()
+
+	config := DefaultDogStatsDConfig
+	config.Address = "udp://" + conn.LocalAddr().String()
+	config.Tags = []string{"env:prod"}
+	config.MaxPacketSize = 80
+	sink := NewDogStatsDSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.Write([]Datapoint{
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders", "kafka_id": "lkc-1"}, Value: 10, Timestamp: timestamp.Add(time.Minute)},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders", "kafka_id": "lkc-1"}, Value: 20, Timestamp: timestamp},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "a,b|c", "kafka_id": "lkc-1"}, Value: 1.5, Timestamp: timestamp},
+	})
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	// Each line exceeds half of the packet size, they are sent in distinct datagrams
+	lines := make([]string, 0)
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < 2 {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Errorf("Expected 2 datagrams, got %v (%s)", lines, err)
+			t.Fail()
+			return
+		}
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+	}
+
+	expected := []string{
+		"ccloud.received_bytes:10|g|#env:prod,kafka_id:lkc-1,topic:orders",
+		"ccloud.received_bytes:1.5|g|#env:prod,kafka_id:lkc-1,topic:a_b_c",
+	}
+	if len(lines) != 2 || lines[0] != expected[0] || lines[1] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected, lines)
+		t.Fail()
+	}
+}
+
+func TestDogStatsDTimestampedSamples(t *testing.T) {
+	config := DefaultDogStatsDConfig
+	config.Samples = "timestamped"
+	sink := NewDogStatsDSink(config)
+
+	line := sink.format(Datapoint{Name: "ccloud_metric_retained_bytes", Value: 42, Timestamp: time.Unix(1609459200, 0)})
+	if line != "ccloud.retained_bytes:42|g|T1609459200" {
+		t.Errorf("Unexpected datagram: %s", line)
+		t.Fail()
+	}
+}
@@ -0,0 +1,290 @@
+package collector
+
+//
+// file_sink.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileConfig configures the file sink
+type FileConfig struct {
+	Path string
+	// MaxSize is the size, in MB, from which the file is rotated
+	MaxSize int
+	// RotationInterval is the age, in second, from which the file is rotated, 0 disables the rotation by time
+	RotationInterval int
+	Compress         bool
+	// StateRetention is the time, in second, during which the latest timestamp written for a series is kept
+	StateRetention int
+}
+
+// DefaultFileConfig is the default configuration of the file sink
+var DefaultFileConfig = FileConfig{
+	MaxSize:          100,
+	RotationInterval: 86400,
+	StateRetention:   86400,
+}
+
+// FileSink appends the data points to a JSON Lines file, e.g. to archive them
+// The latest timestamp written for each series is kept in <path>.state, thus an interval
+// is never written twice for a series, even when it is collected again or after a restart.
+// Series that have not been written within config.sinks.file.stateRetention are removed from the state
+type FileSink struct {
+	config   FileConfig
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// written is the latest timestamp written, in Unix seconds, by series
+	written map[string]int64
+	// compressions tracks the rotated files being compressed
+	compressions sync.WaitGroup
+	sinkBuffer
+}
+
+// fileRecord is a line of the file
+type fileRecord struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Rule      int               `json:"rule"`
+}
+
+// check returns an error describing the first invalid option of the file sink
+func (config FileConfig) check() error {
+	info, err := os.Stat(filepath.Dir(config.Path))
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("the directory of config.sinks.file.path %s does not exist", config.Path)
+	}
+
+	if config.MaxSize <= 0 || config.RotationInterval < 0 {
+		return errors.New("config.sinks.file.maxSize must be positive and config.sinks.file.rotationInterval can not be negative")
+	}
+
+	if config.StateRetention <= 0 {
+		return errors.New("config.sinks.file.stateRetention must be positive")
+	}
+	return nil
+}
+
+// NewFileSink creates a new file sink, restoring the latest timestamp written for each series
+func NewFileSink(config FileConfig) *FileSink {
+	sink := &FileSink{config: config, written: make(map[string]int64)}
+	content, err := ioutil.ReadFile(sink.statePath())
+	if err == nil {
+		err = json.Unmarshal(content, &sink.written)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", sink.statePath()).Warnln("Can not restore the state of the file sink, intervals may be written twice")
+	}
+	return sink
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *FileSink) Name() string {
+	return "file"
+}
+
+func (sink *FileSink) statePath() string {
+	return sink.config.Path + ".state"
+}
+
+// Flush appends the buffered data points that have not been written yet, rotating the file if required
+func (sink *FileSink) Flush() error {
+	points := sink.drain()
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+
+	sink.sendMutex.Lock()
+	defer sink.sendMutex.Unlock()
+	if err := sink.rotateIfRequired(); err != nil {
+		return err
+	}
+	if sink.file == nil {
+		if err := sink.open(); err != nil {
+			return err
+		}
+	}
+
+	writer := bufio.NewWriter(sink.file)
+	encoder := json.NewEncoder(writer)
+	written := make(map[string]int64)
+	count := 0
+	for _, point := range points {
+		// Points without timestamp can not be deduplicated, they are stamped when written
+		timestamp := point.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		key := seriesKey(point)
+		latest, present := written[key]
+		if !present {
+			latest, present = sink.written[key]
+		}
+		if present && timestamp.Unix() <= latest {
+			continue
+		}
+
+		record := fileRecord{Timestamp: timestamp.UTC(), Metric: point.Name, Labels: point.Labels, Value: point.Value, Rule: point.Rule}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		written[key] = timestamp.Unix()
+		count++
+	}
+
+	err := writer.Flush()
+	if info, statErr := sink.file.Stat(); statErr == nil {
+		sink.size = info.Size()
+	}
+	if err != nil {
+		sinkPoints.WithLabelValues(sink.Name(), "failed").Add(float64(count))
+		return fmt.Errorf("can not write to %s: %s", sink.config.Path, err)
+	}
+	sinkPoints.WithLabelValues(sink.Name(), "sent").Add(float64(count))
+
+	if count == 0 {
+		return nil
+	}
+	for key, timestamp := range written {
+		sink.written[key] = timestamp
+	}
+	sink.pruneState()
+	log.WithFields(log.Fields{"dataPoints": count, "path": sink.config.Path}).Debugln("Data points have been written to the file")
+	return sink.saveState()
+}
+
+// pruneState removes the series whose latest timestamp is older than config.sinks.file.stateRetention,
+// relatively to the latest timestamp written, e.g. topics that have been deleted
+func (sink *FileSink) pruneState() {
+	var newest int64
+	for _, timestamp := range sink.written {
+		if timestamp > newest {
+			newest = timestamp
+		}
+	}
+	oldest := newest - int64(sink.config.StateRetention)
+	for key, timestamp := range sink.written {
+		if timestamp < oldest {
+			delete(sink.written, key)
+		}
+	}
+}
+
+// saveState atomically replaces the state file
+func (sink *FileSink) saveState() error {
+	content, err := json.Marshal(sink.written)
+	if err != nil {
+		return err
+	}
+	tmp := sink.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return fmt.Errorf("can not save the state of the file sink: %s", err)
+	}
+	return os.Rename(tmp, sink.statePath())
+}
+
+// open opens the file in append mode, an existing file is rotated based on its modification time
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("can not open %s: %s", sink.config.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	sink.file = file
+	sink.size = info.Size()
+	sink.openedAt = time.Now()
+	if sink.size > 0 {
+		sink.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+// rotateIfRequired renames the file once it reaches config.sinks.file.maxSize or config.sinks.file.rotationInterval,
+// the rotated file is suffixed by the time of the rotation, e.g. metrics.jsonl.20210101T000000.000
+func (sink *FileSink) rotateIfRequired() error {
+	if sink.file == nil {
+		if _, err := os.Stat(sink.config.Path); err != nil {
+			return nil
+		}
+		if err := sink.open(); err != nil {
+			return err
+		}
+	}
+
+	tooLarge := sink.size >= int64(sink.config.MaxSize)*1024*1024
+	tooOld := sink.config.RotationInterval > 0 && time.Since(sink.openedAt) >= time.Second*time.Duration(sink.config.RotationInterval)
+	if sink.size == 0 || (!tooLarge && !tooOld) {
+		return nil
+	}
+
+	sink.file.Close()
+	sink.file = nil
+	rotated := sink.config.Path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(sink.config.Path, rotated); err != nil {
+		return fmt.Errorf("can not rotate %s: %s", sink.config.Path, err)
+	}
+	log.WithField("path", rotated).Infoln("File sink has been rotated")
+
+	if sink.config.Compress {
+		sink.compressions.Add(1)
+		go func() {
+			defer sink.compressions.Done()
+			compressFile(rotated)
+		}()
+	}
+	return nil
+}
+
+// compressFile compresses a rotated file to <path>.gz and removes it
+func compressFile(path string) {
+	err := func() error {
+		source, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+
+		destination, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		writer := gzip.NewWriter(destination)
+		if _, err = io.Copy(writer, source); err == nil {
+			err = writer.Close()
+		}
+		if closeErr := destination.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path + ".gz")
+			return err
+		}
+		return os.Remove(path)
+	}()
+	if err != nil {
+		log.WithError(err).WithField("path", path).Errorln("Can not compress the rotated file")
+	}
+}
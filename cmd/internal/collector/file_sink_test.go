@@ -0,0 +1,117 @@
+package collector
+
+//
+// file_sink_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, content []byte) []fileRecord {
+	records := make([]fileRecord, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		if line == "" {
+			continue
+		}
+		record := fileRecord{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid line %s: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Fatalf("Can not create a temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultFileConfig
+	config.Path = filepath.Join(dir, "metrics.jsonl")
+	config.Compress = true
+	sink := NewFileSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	labels := map[string]string{"kafka_id": "lkc-1", "topic": "orders"}
+	point := func(minutes int, value float64) Datapoint {
+		return Datapoint{Name: "ccloud_metric_received_bytes", Labels: labels, Value: value, Timestamp: timestamp.Add(time.Duration(minutes) * time.Minute), Rule: 1}
+	}
+
+	sink.Write([]Datapoint{point(1, 20), point(0, 10)})
+	sink.Flush()
+	// The first interval is collected again, it must not be written twice
+	sink.Write([]Datapoint{point(1, 20), point(2, 30)})
+	sink.Flush()
+
+	content, _ := ioutil.ReadFile(config.Path)
+	records := readRecords(t, content)
+	if len(records) != 3 || records[0].Value != 10 || records[2].Value != 30 {
+		t.Errorf("Expected 3 records in order, got %v", records)
+		t.Fail()
+		return
+	}
+	if !records[0].Timestamp.Equal(timestamp) || records[0].Labels["topic"] != "orders" || records[0].Rule != 1 || records[0].Metric != "ccloud_metric_received_bytes" {
+		t.Errorf("Unexpected record: %+v", records[0])
+		t.Fail()
+	}
+
+	// The file is rotated once it is older than the rotation interval
+	sink.openedAt = time.Now().Add(-48 * time.Hour)
+	sink.Write([]Datapoint{point(3, 40)})
+	sink.Flush()
+	sink.compressions.Wait()
+
+	rotated, _ := filepath.Glob(config.Path + ".*.gz")
+	if len(rotated) != 1 {
+		t.Errorf("Expected a compressed rotated file, got %v", rotated)
+		t.Fail()
+		return
+	}
+	file, _ := os.Open(rotated[0])
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Errorf("Invalid gzip file: %s", err)
+		t.Fail()
+		return
+	}
+	content, _ = ioutil.ReadAll(reader)
+	if len(readRecords(t, content)) != 3 {
+		t.Errorf("Expected the rotated file to contain 3 records")
+		t.Fail()
+	}
+
+	// After a restart, intervals already written are still skipped
+	sink = NewFileSink(config)
+	sink.Write([]Datapoint{point(3, 40), point(4, 50)})
+	sink.Flush()
+	content, _ = ioutil.ReadFile(config.Path)
+	records = readRecords(t, content)
+	if len(records) != 2 || records[0].Value != 40 || records[1].Value != 50 {
+		t.Errorf("Expected each interval to be written once, got %v", records)
+		t.Fail()
+	}
+
+	// Series that are no longer written are removed from the state once stateRetention has elapsed
+	deleted := Datapoint{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"kafka_id": "lkc-1", "topic": "deleted"}, Value: 1, Timestamp: timestamp}
+	sink.Write([]Datapoint{deleted, point(2*24*60, 60)})
+	sink.Flush()
+	if _, present := sink.written[seriesKey(deleted)]; present || len(sink.written) != 1 {
+		t.Errorf("Expected the state to only contain the series written recently, got %v", sink.written)
+		t.Fail()
+	}
+}
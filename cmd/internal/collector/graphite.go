@@ -0,0 +1,192 @@
+package collector
+
+//
+// graphite.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GraphiteConfig configures the Graphite sink
+type GraphiteConfig struct {
+	Address string
+	// Template is the path of the metrics, {labels} is replaced by the values of the labels the rule groups by,
+	// {metric} by the name of the metric and {<label>} by the value of the label, e.g. {topic}
+	Template string
+	// Templates overrides Template for specific metrics, by name of the metric, e.g. received_bytes
+	Templates     map[string]string
+	Timeout       int
+	MaxBufferSize int
+}
+
+// DefaultGraphiteConfig is the default configuration of the Graphite sink
+var DefaultGraphiteConfig = GraphiteConfig{
+	Template:      "ccloud.{labels}.{metric}",
+	Timeout:       10,
+	MaxBufferSize: 100000,
+}
+
+// GraphiteSink sends the data points to Graphite with the plaintext protocol over TCP
+// Lines that can not be sent are kept, up to config.sinks.graphite.maxBufferSize lines,
+// and sent once the connection is re-established
+type GraphiteSink struct {
+	config  GraphiteConfig
+	conn    net.Conn
+	pending []string
+	sinkBuffer
+}
+
+var (
+	// graphiteTemplatePlaceholder matches the placeholders of a path template, e.g. {topic}
+	graphiteTemplatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+	// invalidGraphiteNodeChar matches the characters replaced in a node of a path, dots separating the nodes
+	invalidGraphiteNodeChar = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+)
+
+// check returns an error describing the first invalid option of the Graphite sink
+func (config GraphiteConfig) check() error {
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return fmt.Errorf("config.sinks.graphite.address is not a valid address: %s", err)
+	}
+
+	if config.Template == "" {
+		return errors.New("config.sinks.graphite.template can not be empty")
+	}
+
+	if config.Timeout <= 0 || config.MaxBufferSize <= 0 {
+		return errors.New("config.sinks.graphite.timeout and config.sinks.graphite.maxBufferSize must be positive")
+	}
+	return nil
+}
+
+// NewGraphiteSink creates a new Graphite sink, the connection is established on the first flush
+func NewGraphiteSink(config GraphiteConfig) *GraphiteSink {
+	return &GraphiteSink{config: config}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *GraphiteSink) Name() string {
+	return "graphite"
+}
+
+// Flush sends the buffered data points, along with the lines that could not be sent previously
+func (sink *GraphiteSink) Flush() error {
+	points := sink.drain()
+	groupByLabels := make(map[int][]string)
+	for _, rule := range Context.GetRules() {
+		groupByLabels[rule.id] = rule.GroupByLabels
+	}
+
+	sink.sendMutex.Lock()
+	defer sink.sendMutex.Unlock()
+	for _, point := range points {
+		sink.pending = append(sink.pending, sink.format(point, groupByLabels[point.Rule]))
+	}
+	if dropped := len(sink.pending) - sink.config.MaxBufferSize; dropped > 0 {
+		log.WithFields(log.Fields{"lines": dropped, "address": sink.config.Address}).Warnln("Graphite buffer is full, dropping the oldest lines")
+		sinkPoints.WithLabelValues(sink.Name(), "failed").Add(float64(dropped))
+		sink.pending = sink.pending[dropped:]
+	}
+
+	sent, err := sink.send(sink.pending)
+	sinkPoints.WithLabelValues(sink.Name(), "sent").Add(float64(sent))
+	sink.pending = sink.pending[sent:]
+	if err != nil {
+		return fmt.Errorf("%s, %d lines are kept until the connection is re-established", err, len(sink.pending))
+	}
+	log.WithFields(log.Fields{"lines": sent, "address": sink.config.Address}).Debugln("Data points have been sent to Graphite")
+	return nil
+}
+
+// send writes lines to the connection, establishing it if required, and returns the number of lines fully written
+// The connection is closed if a write fails
+func (sink *GraphiteSink) send(lines []string) (int, error) {
+	if len(lines) == 0 {
+		return 0, nil
+	}
+
+	timeout := time.Second * time.Duration(sink.config.Timeout)
+	if sink.conn == nil {
+		conn, err := net.DialTimeout("tcp", sink.config.Address, timeout)
+		if err != nil {
+			return 0, fmt.Errorf("can not connect to Graphite at %s: %s", sink.config.Address, err)
+		}
+		sink.conn = conn
+	}
+
+	payload := strings.Join(lines, "")
+	sink.conn.SetWriteDeadline(time.Now().Add(timeout))
+	written, err := sink.conn.Write([]byte(payload))
+	if err == nil {
+		return len(lines), nil
+	}
+
+	sink.conn.Close()
+	sink.conn = nil
+	sent := 0
+	for _, line := range lines {
+		if written < len(line) {
+			break
+		}
+		written -= len(line)
+		sent++
+	}
+	return sent, fmt.Errorf("can not send data points to Graphite at %s: %s", sink.config.Address, err)
+}
+
+// format returns the plaintext line of a data point, e.g.
+//
+//	ccloud.lkc-1.orders.received_bytes 42 1609459200
+func (sink *GraphiteSink) format(point Datapoint, groupByLabels []string) string {
+	metric := strings.TrimPrefix(point.Name, "ccloud_metric_")
+	template, present := sink.config.Templates[metric]
+	if !present {
+		template = sink.config.Template
+	}
+
+	path := graphiteTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case "metric":
+			return metric
+		case "labels":
+			nodes := make([]string, 0, len(groupByLabels))
+			for _, label := range groupByLabels {
+				if value, present := point.Labels[GetPrometheusNameForLabel(label)]; present {
+					nodes = append(nodes, graphiteNode(value))
+				}
+			}
+			return strings.Join(nodes, ".")
+		default:
+			return graphiteNode(point.Labels[name])
+		}
+	})
+	// Labels absent from the data point would leave empty nodes
+	for strings.Contains(path, "..") {
+		path = strings.Replace(path, "..", ".", -1)
+	}
+	path = strings.Trim(path, ".")
+
+	timestamp := point.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	return path + " " + strconv.FormatFloat(point.Value, 'f', -1, 64) + " " + strconv.FormatInt(timestamp.Unix(), 10) + "\n"
+}
+
+// graphiteNode sanitizes a label value to be used as a node of a path, e.g. the dots of topic names are replaced
+func graphiteNode(value string) string {
+	return invalidGraphiteNodeChar.ReplaceAllString(value, "_")
+}
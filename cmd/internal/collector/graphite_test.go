@@ -0,0 +1,95 @@
+package collector
+
+//
+// graphite_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGraphiteFormat(t *testing.T) {
+	config := DefaultGraphiteConfig
+	config.Templates = map[string]string{"retained_bytes": "ccloud.{kafka_id}.{topic}.{partition}.retained_bytes"}
+	sink := NewGraphiteSink(config)
+	timestamp := time.Unix(1609459200, 0)
+	labels := map[string]string{"kafka_id": "lkc-1", "topic": "team.orders", "partition": "0"}
+
+	line := sink.format(Datapoint{Name: "ccloud_metric_received_bytes", Labels: labels, Value: 42, Timestamp: timestamp}, []string{"kafka.id", "topic", "type"})
+	if line != "ccloud.lkc-1.team_orders.received_bytes 42 1609459200\n" {
+		t.Errorf("Unexpected line: %s", line)
+		t.Fail()
+	}
+
+	line = sink.format(Datapoint{Name: "ccloud_metric_retained_bytes", Labels: labels, Value: 1.5, Timestamp: timestamp}, nil)
+	if line != "ccloud.lkc-1.team_orders.0.retained_bytes 1.5 1609459200\n" {
+		t.Errorf("Unexpected line: %s", line)
+		t.Fail()
+	}
+}
+
+func TestGraphiteSinkReconnect(t *testing.T) {
+	Context = ExporterContext{Rules: []Rule{{id: 0, GroupByLabels: []string{"topic"}}}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Can not listen: %s", err)
+		t.Fail()
+		return
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := DefaultGraphiteConfig
+	config.Address = address
+	config.Timeout = 1
+	sink := NewGraphiteSink(config)
+	timestamp := time.Unix(1609459200, 0)
+
+	// Graphite is down, the line is kept
+	sink.Write([]Datapoint{{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders"}, Value: 1, Timestamp: timestamp}})
+	if sink.Flush() == nil || len(sink.pending) != 1 {
+		t.Errorf("Expected the line to be kept, got %d pending lines", len(sink.pending))
+		t.Fail()
+		return
+	}
+
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Errorf("Can not listen: %s", err)
+		t.Fail()
+		return
+	}
+	defer listener.Close()
+	sink.Write([]Datapoint{{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders"}, Value: 2, Timestamp: timestamp.Add(time.Minute)}})
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Errorf("Can not accept: %s", err)
+		t.Fail()
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	expected := []string{"ccloud.orders.received_bytes 1 1609459200\n", "ccloud.orders.received_bytes 2 1609459260\n"}
+	for _, expectedLine := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expectedLine {
+			t.Errorf("Expected %s, got %s (%v)", expectedLine, line, err)
+			t.Fail()
+			return
+		}
+	}
+}
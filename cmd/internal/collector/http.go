@@ -9,23 +9,28 @@ package collector
 
 import "io"
 import "net/http"
-import log "github.com/sirupsen/logrus"
 
-// MustGetNewRequest creates a new HTTP Request and set all
+// NewRequest creates a new HTTP Request and set all
 // the required headers to identify the ccloudexporter
-func MustGetNewRequest(method string, endpoint string, reader io.Reader) *http.Request {
+func NewRequest(method string, endpoint string, reader io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, endpoint, reader)
 	if err != nil {
-		log.WithError(err).Fatalln()
+		return nil, err
 	}
 
-	apikey := MustGetAPIKey()
-	apisecret := MustGetAPISecret()
+	apikey, err := GetAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	apisecret, err := GetAPISecret()
+	if err != nil {
+		return nil, err
+	}
 
 	req.SetBasicAuth(apikey, apisecret)
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("User-Agent", "ccloudexporter/"+Version)
 	req.Header.Add("Correlation-Context", "service.name=ccloudexporter,service.version="+Version)
 
-	return req
+	return req, nil
 }
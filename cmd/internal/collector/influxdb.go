@@ -0,0 +1,164 @@
+package collector
+
+//
+// influxdb.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InfluxDBConfig configures the InfluxDB sink
+type InfluxDBConfig struct {
+	URL       string
+	Org       string
+	Bucket    string
+	Token     string
+	BatchSize int
+	Timeout   int
+	Retry     RetryPolicy
+}
+
+// DefaultInfluxDBConfig is the default configuration of the InfluxDB sink
+var DefaultInfluxDBConfig = InfluxDBConfig{
+	BatchSize: 5000,
+	Timeout:   30,
+	Retry:     DefaultRetryPolicy,
+}
+
+// String returns the configuration with the token redacted, as it is logged on startup
+func (config InfluxDBConfig) String() string {
+	type plain InfluxDBConfig
+	config.Token = redact(config.Token)
+	return fmt.Sprintf("%+v", plain(config))
+}
+
+// InfluxDBSink writes the data points to an InfluxDB v2 bucket with the write API
+// Each metric is a measurement, with the labels as tags and the value in the value field
+type InfluxDBSink struct {
+	config InfluxDBConfig
+	client http.Client
+	sinkBuffer
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// check returns an error describing the first invalid option of the InfluxDB sink
+func (config InfluxDBConfig) check() error {
+	if _, err := url.ParseRequestURI(config.URL); err != nil {
+		return fmt.Errorf("config.sinks.influxdb.url is not a valid URL: %s", err)
+	}
+
+	if config.Org == "" || config.Bucket == "" {
+		return errors.New("config.sinks.influxdb.org and config.sinks.influxdb.bucket are required")
+	}
+
+	if config.BatchSize <= 0 || config.Timeout <= 0 {
+		return errors.New("config.sinks.influxdb.batchSize and config.sinks.influxdb.timeout must be positive")
+	}
+
+	return checkRetryPolicy(config.Retry, "config.sinks.influxdb.retry")
+}
+
+// NewInfluxDBSink creates a new InfluxDB sink
+func NewInfluxDBSink(config InfluxDBConfig) *InfluxDBSink {
+	return &InfluxDBSink{
+		config: config,
+		client: http.Client{Timeout: time.Second * time.Duration(config.Timeout)},
+	}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *InfluxDBSink) Name() string {
+	return "influxdb"
+}
+
+// Flush writes the buffered data points, in batches of config.sinks.influxdb.batchSize lines
+// A batch that can not be written after all retries is dropped
+func (sink *InfluxDBSink) Flush() error {
+	return sink.flush(sink.Name(), sink.config.BatchSize, sink.send)
+}
+
+// send writes a single batch of lines
+func (sink *InfluxDBSink) send(points []Datapoint) error {
+	body := encodeLineProtocol(points)
+	endpoint := strings.TrimSuffix(sink.config.URL, "/") + "/api/v2/write?" + url.Values{
+		"org":       {sink.config.Org},
+		"bucket":    {sink.config.Bucket},
+		"precision": {"s"},
+	}.Encode()
+
+	res, resBody, err := sendToSink(&sink.client, sink.config.Retry, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.Header.Set("User-Agent", "ccloudexporter/"+Version)
+		if sink.config.Token != "" {
+			req.Header.Set("Authorization", "Token "+sink.config.Token)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("InfluxDB write to %s failed: %s", sink.config.URL, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d from %s (%s)", res.StatusCode, sink.config.URL, resBody)
+	}
+	log.WithFields(log.Fields{"lines": len(points), "url": sink.config.URL}).Debugln("Data points have been written to InfluxDB")
+	return nil
+}
+
+// encodeLineProtocol encodes data points as InfluxDB line protocol, with a precision of a second, e.g.
+//
+//	ccloud_metric_received_bytes,kafka_id=lkc-1,topic=orders value=42 1609459200
+//
+// Tags are sorted by key, as recommended by InfluxDB, tags with an empty value are omitted
+func encodeLineProtocol(points []Datapoint) []byte {
+	var buffer bytes.Buffer
+	for _, point := range points {
+		timestamp := point.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+
+		names := make([]string, 0, len(point.Labels))
+		for name, value := range point.Labels {
+			if value != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		buffer.WriteString(influxMeasurementEscaper.Replace(point.Name))
+		for _, name := range names {
+			buffer.WriteString(",")
+			buffer.WriteString(influxTagEscaper.Replace(name))
+			buffer.WriteString("=")
+			buffer.WriteString(influxTagEscaper.Replace(point.Labels[name]))
+		}
+		buffer.WriteString(" value=")
+		buffer.WriteString(strconv.FormatFloat(point.Value, 'f', -1, 64))
+		buffer.WriteString(" ")
+		buffer.WriteString(strconv.FormatInt(timestamp.Unix(), 10))
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
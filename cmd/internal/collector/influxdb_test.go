@@ -0,0 +1,91 @@
+package collector
+
+//
+// influxdb_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInfluxDBSink(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	lines := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		// The first request fails, it must be retried
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v2/write" || query.Get("org") != "confluent" || query.Get("bucket") != "ccloud" || query.Get("precision") != "s" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := DefaultInfluxDBConfig
+	config.URL = server.URL
+	config.Org = "confluent"
+	config.Bucket = "ccloud"
+	config.Token = "secret"
+	config.BatchSize = 2
+	config.Retry = RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	sink := NewInfluxDBSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.Write([]Datapoint{
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders", "kafka_id": "lkc-1"}, Value: 10, Timestamp: timestamp},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "my orders,v2", "kafka_id": "lkc-1"}, Value: 2.5, Timestamp: timestamp},
+		{Name: "ccloud_metric_retained_bytes", Labels: map[string]string{"topic": "", "kafka_id": "lkc-1"}, Value: 20, Timestamp: timestamp},
+	})
+	err := sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	expected := []string{
+		"ccloud_metric_received_bytes,kafka_id=lkc-1,topic=orders value=10 1609459200",
+		`ccloud_metric_received_bytes,kafka_id=lkc-1,topic=my\ orders\,v2 value=2.5 1609459200`,
+		"ccloud_metric_retained_bytes,kafka_id=lkc-1 value=20 1609459200",
+	}
+	// 2 batches, the first one being retried
+	if requests != 3 || strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected 3 requests writing %v, got %d requests writing %v", expected, requests, lines)
+		t.Fail()
+	}
+}
+
+func TestInfluxDBConfig(t *testing.T) {
+	config := DefaultInfluxDBConfig
+	config.URL = "http://localhost:8086"
+	config.Org = "confluent"
+	if checkSinks(SinksConfig{InfluxDB: config}) == nil {
+		t.Errorf("Expected the bucket to be required")
+		t.Fail()
+	}
+}
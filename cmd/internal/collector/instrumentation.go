@@ -0,0 +1,96 @@
+package collector
+
+//
+// instrumentation.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics describing the behavior of the exporter itself
+// They are never cached and are exposed alongside the Metrics API results
+var (
+	pagesFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ccloud_metrics_api_pages_total",
+		Help: "Number of pages fetched from the Metrics API query endpoint",
+	})
+
+	truncatedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ccloud_metrics_api_truncated_queries_total",
+		Help: "Number of query responses truncated at config.http.maxPages pages",
+	})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ccloud_metrics_api_retries_total",
+		Help: "Number of requests to the Metrics API that have been retried, by reason",
+	}, []string{"reason"})
+
+	failedQueries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ccloud_metrics_api_failed_queries_total",
+		Help: "Number of queries to the Metrics API that did not succeed, after all retries",
+	})
+
+	sinkPoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ccloud_exporter_sink_points_total",
+		Help: "Number of data points pushed to the sinks, by sink and result",
+	}, []string{"sink", "result"})
+
+	queueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ccloud_metrics_api_queue_wait_seconds",
+		Help:    "Time spent by requests waiting for the rate limiter before being sent to the Metrics API",
+		Buckets: []float64{0.001, 0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	exporterUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ccloud_exporter_up",
+		Help: "1 if the metrics exposed by the Metrics API have been discovered and are being collected, 0 otherwise",
+	})
+
+	descriptorLastRefresh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ccloud_exporter_descriptor_last_refresh_timestamp_seconds",
+		Help: "Timestamp of the last successful discovery of the metrics exposed by the Metrics API",
+	})
+
+	descriptorChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ccloud_exporter_descriptor_changes_total",
+		Help: "Number of metrics and labels added or removed from the Metrics API since the exporter started",
+	}, []string{"kind", "change"})
+
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ccloud_exporter_config_last_reload_success",
+		Help: "1 if the last reload of the configuration file succeeded, 0 otherwise",
+	})
+
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ccloud_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful reload of the configuration file",
+	})
+
+	instrumentation = []prometheus.Collector{
+		exporterUp,
+		descriptorLastRefresh,
+		descriptorChanges,
+		configLastReloadSuccess,
+		configLastReloadSuccessTimestamp,
+		pagesFetched,
+		truncatedQueries,
+		retries,
+		failedQueries,
+		queueWait,
+		sinkPoints,
+	}
+)
+
+func describeInstrumentation(ch chan<- *prometheus.Desc) {
+	for _, collector := range instrumentation {
+		collector.Describe(ch)
+	}
+}
+
+func collectInstrumentation(ch chan<- prometheus.Metric) {
+	for _, collector := range instrumentation {
+		collector.Collect(ch)
+	}
+}
@@ -0,0 +1,141 @@
+package collector
+
+//
+// limiter.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestLimiter bounds the requests sent to the Metrics API, requests to other APIs are not limited
+// It combines a token bucket, limiting the number of requests per second,
+// and a semaphore, limiting the number of requests in flight.
+// A zero value for either limit disables it.
+type RequestLimiter struct {
+	mutex    sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	inFlight chan struct{}
+}
+
+var (
+	limiter = NewRequestLimiter(0, 0)
+)
+
+// NewRequestLimiter creates a limiter allowing requestsPerSecond requests per second
+// with at most maxConcurrentRequests requests in flight
+func NewRequestLimiter(requestsPerSecond float64, maxConcurrentRequests int) *RequestLimiter {
+	burst := math.Max(1, math.Ceil(requestsPerSecond))
+	rl := &RequestLimiter{
+		rate:   requestsPerSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+	if maxConcurrentRequests > 0 {
+		rl.inFlight = make(chan struct{}, maxConcurrentRequests)
+	}
+	return rl
+}
+
+// Acquire blocks until a request can be sent or ctx is done
+// The returned function must be called once the request has completed
+func (rl *RequestLimiter) Acquire(ctx context.Context) (func(), error) {
+	start := time.Now()
+	defer func() {
+		queueWait.Observe(time.Since(start).Seconds())
+	}()
+
+	if rl.inFlight != nil {
+		select {
+		case rl.inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		if rl.inFlight != nil {
+			<-rl.inFlight
+		}
+	}
+
+	wait := rl.reserve()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			rl.cancelReservation()
+			release()
+			return nil, ctx.Err()
+		}
+	}
+
+	return release, nil
+}
+
+// reserve takes a token from the bucket and returns how long
+// the caller needs to wait before the token is actually available
+func (rl *RequestLimiter) reserve() time.Duration {
+	if rl.rate <= 0 {
+		return 0
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+func (rl *RequestLimiter) cancelReservation() {
+	if rl.rate <= 0 {
+		return
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.tokens++
+}
+
+// doLimited sends the request with the client once the limiter allows it, a nil limiter does not bound the request
+// The body of the response is fully read and returned, the response body is always closed
+func doLimited(rl *RequestLimiter, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	if rl != nil {
+		release, err := rl.Acquire(req.Context())
+		if err != nil {
+			return nil, nil, err
+		}
+		defer release()
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, body, nil
+}
@@ -0,0 +1,84 @@
+package collector
+
+//
+// limiter_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterBoundsConcurrentRequests(t *testing.T) {
+	rl := NewRequestLimiter(0, 2)
+
+	var inFlight, maxInFlight int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := rl.Acquire(context.Background())
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 5)
+			atomic.AddInt32(&inFlight, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight > 2 {
+		t.Errorf("Expected at most 2 requests in flight, got %d", maxInFlight)
+		t.Fail()
+	}
+}
+
+func TestLimiterBoundsRequestRate(t *testing.T) {
+	rl := NewRequestLimiter(20, 0)
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		release, err := rl.Acquire(context.Background())
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+			t.Fail()
+			return
+		}
+		release()
+	}
+
+	// 20 requests are allowed by the initial burst, the 10 remaining take 500ms
+	if elapsed := time.Since(start); elapsed < time.Millisecond*400 {
+		t.Errorf("Requests have not been rate limited, took %s", elapsed)
+		t.Fail()
+	}
+}
+
+func TestLimiterHonorsContextDeadline(t *testing.T) {
+	rl := NewRequestLimiter(0, 1)
+	release, _ := rl.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := rl.Acquire(ctx); err == nil {
+		t.Errorf("Expected the acquisition to fail once the deadline is reached")
+		t.Fail()
+	}
+}
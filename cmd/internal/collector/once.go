@@ -0,0 +1,196 @@
+package collector
+
+//
+// once.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// PushgatewayConfig configures the Pushgateway the metrics are pushed to by the --once mode
+type PushgatewayConfig struct {
+	URL string
+	Job string
+	// GroupingKey is added to the grouping key of every push, e.g. instance: nightly
+	GroupingKey map[string]string
+	// GroupBy pushes the metrics in a distinct group for each value of these labels, e.g. kafka_id
+	GroupBy  []string
+	Username string
+	Password string
+	Timeout  int
+}
+
+// DefaultPushgatewayConfig is the default configuration of the Pushgateway
+var DefaultPushgatewayConfig = PushgatewayConfig{
+	Job:     "ccloudexporter",
+	Timeout: 30,
+}
+
+// String returns the configuration with the password redacted, as it is logged on startup
+func (config PushgatewayConfig) String() string {
+	type plain PushgatewayConfig
+	config.Password = redact(config.Password)
+	return fmt.Sprintf("%+v", plain(config))
+}
+
+// pushGroup is a set of metric families pushed with the same grouping key
+type pushGroup struct {
+	labels   map[string]string
+	families []*dto.MetricFamily
+}
+
+// checkPushgateway returns an error describing the first invalid option of the Pushgateway
+func checkPushgateway(config PushgatewayConfig) error {
+	if _, err := url.ParseRequestURI(config.URL); err != nil {
+		return fmt.Errorf("-pushgateway or config.pushgateway.url is required by --once and must be a valid URL: %s", err)
+	}
+
+	if config.Job == "" {
+		return errors.New("config.pushgateway.job can not be empty")
+	}
+
+	if config.Timeout <= 0 {
+		return errors.New("config.pushgateway.timeout must be positive")
+	}
+	return nil
+}
+
+// RunOnce executes every rule a single time, pushes the metrics to the Pushgateway and flushes the sinks
+// An error is returned if any rule or push did not succeed, so scheduled runs can be detected as failed
+func RunOnce() error {
+	// A running total would restart on every run, and the Pushgateway rejects samples with a timestamp
+	Context.AccumulateDeltas = false
+	Context.NoTimestamp = true
+
+	initHTTPClient()
+	dispatcher.SetSinks(newConfiguredSinks())
+	if isDiscoveryConfigured() {
+		_, err := refreshDiscoveredResources()
+		if err != nil {
+			return fmt.Errorf("can not discover the resources of the organization: %s", err)
+		}
+	}
+	refreshResolvedTopics()
+
+	collector := &CCloudCollector{rules: Context.GetRules(), metrics: make(map[string]CCloudCollectorMetric), cache: NewCache(0, false), store: NewMetricStore()}
+	err := collector.discover()
+	if err != nil {
+		return fmt.Errorf("can not discover the metrics exposed by the Metrics API: %s", err)
+	}
+
+	// The metrics collected are pushed even if some queries did not succeed
+	families, collectErr := collector.collectFamilies(context.Background())
+	dispatcher.Flush()
+	pushErr := pushFamilies(Context.Pushgateway, families)
+	if collectErr != nil {
+		return collectErr
+	}
+	return pushErr
+}
+
+// pushFamilies replaces the metrics of each group in the Pushgateway
+func pushFamilies(config PushgatewayConfig, families map[string]*dto.MetricFamily) error {
+	client := &http.Client{Timeout: time.Second * time.Duration(config.Timeout)}
+	var lastErr error
+	for _, group := range groupFamilies(families, config.GroupBy) {
+		families := group.families
+		pusher := push.New(config.URL, config.Job).Client(client).Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, nil
+		}))
+		if config.Username != "" {
+			pusher = pusher.BasicAuth(config.Username, config.Password)
+		}
+		for name, value := range config.GroupingKey {
+			pusher = pusher.Grouping(name, value)
+		}
+		for name, value := range group.labels {
+			pusher = pusher.Grouping(name, value)
+		}
+
+		err := pusher.Push()
+		if err != nil {
+			log.WithError(err).WithField("group", group.labels).Errorln("Can not push the metrics to the Pushgateway")
+			lastErr = err
+			continue
+		}
+		log.WithFields(log.Fields{"group": group.labels, "families": len(group.families)}).Infoln("Metrics have been pushed to the Pushgateway")
+	}
+	return lastErr
+}
+
+// groupFamilies splits the metric families by the values of the groupBy labels, sorted by grouping key
+// The groupBy labels are removed from the metrics, as the Pushgateway adds the grouping key to all metrics of a group
+// A metric without one of the labels is pushed in the group where this label is empty
+func groupFamilies(families map[string]*dto.MetricFamily, groupBy []string) []*pushGroup {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := make(map[string]*pushGroup)
+	groupFamilies := make(map[string]map[string]*dto.MetricFamily)
+	for _, name := range names {
+		family := families[name]
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range groupBy {
+				labels[label] = ""
+			}
+			pairs := make([]*dto.LabelPair, 0, len(metric.GetLabel()))
+			for _, pair := range metric.GetLabel() {
+				if _, present := labels[pair.GetName()]; present {
+					labels[pair.GetName()] = pair.GetValue()
+				} else {
+					pairs = append(pairs, pair)
+				}
+			}
+
+			parts := make([]string, 0, len(groupBy))
+			for _, label := range groupBy {
+				parts = append(parts, label+"="+labels[label])
+			}
+			key := strings.Join(parts, ",")
+			group, present := groups[key]
+			if !present {
+				group = &pushGroup{labels: labels}
+				groups[key] = group
+				groupFamilies[key] = make(map[string]*dto.MetricFamily)
+			}
+			groupFamily, present := groupFamilies[key][name]
+			if !present {
+				groupFamily = &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				groupFamilies[key][name] = groupFamily
+				group.families = append(group.families, groupFamily)
+			}
+			groupFamily.Metric = append(groupFamily.Metric, &dto.Metric{Label: pairs, Gauge: metric.Gauge, Counter: metric.Counter, Untyped: metric.Untyped})
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*pushGroup, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+	return result
+}
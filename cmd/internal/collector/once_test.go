@@ -0,0 +1,170 @@
+package collector
+
+//
+// once_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func newGaugeFamily(name string, metrics ...*dto.Metric) *dto.MetricFamily {
+	help := "help"
+	return &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_GAUGE.Enum(), Metric: metrics}
+}
+
+// gaugeSample returns a gauge sample with the given label names and values, e.g. gaugeSample(1, "topic", "orders")
+func gaugeSample(value float64, labels ...string) *dto.Metric {
+	sample := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+	for i := 0; i < len(labels); i += 2 {
+		sample.Label = append(sample.Label, &dto.LabelPair{Name: &labels[i], Value: &labels[i+1]})
+	}
+	return sample
+}
+
+func TestPushFamiliesByCluster(t *testing.T) {
+	var mutex sync.Mutex
+	pushed := make(map[string][]*dto.Metric)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method != "PUT" || !strings.Contains(r.URL.Path, "/job/ccloudexporter/") || !strings.Contains(r.URL.Path, "/instance/nightly") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		family := &dto.MetricFamily{}
+		for decoder.Decode(family) == nil {
+			for _, cluster := range []string{"lkc-1", "lkc-2"} {
+				if strings.Contains(r.URL.Path, "/kafka_id/"+cluster) {
+					pushed[cluster] = append(pushed[cluster], family.GetMetric()...)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	families := map[string]*dto.MetricFamily{"ccloud_metric_received_bytes": newGaugeFamily("ccloud_metric_received_bytes",
+		gaugeSample(1, "kafka_id", "lkc-1", "topic", "orders"),
+		gaugeSample(2, "kafka_id", "lkc-2", "topic", "orders"),
+		gaugeSample(3, "kafka_id", "lkc-1", "topic", "payments"),
+	)}
+
+	config := DefaultPushgatewayConfig
+	config.URL = server.URL
+	config.GroupingKey = map[string]string{"instance": "nightly"}
+	config.GroupBy = []string{"kafka_id"}
+	err := pushFamilies(config, families)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(pushed["lkc-1"]) != 2 || len(pushed["lkc-2"]) != 1 {
+		t.Errorf("Expected a group per cluster, got %v", pushed)
+		t.Fail()
+		return
+	}
+	// The cluster is part of the grouping key, not of the labels of the metrics
+	if labels := pushed["lkc-2"][0].GetLabel(); len(labels) != 1 || labels[0].GetName() != "topic" {
+		t.Errorf("Unexpected labels: %v", labels)
+		t.Fail()
+	}
+}
+
+func TestPushFamiliesFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	config := DefaultPushgatewayConfig
+	config.URL = server.URL
+	err := pushFamilies(config, map[string]*dto.MetricFamily{
+		"ccloud_metric_received_bytes": newGaugeFamily("ccloud_metric_received_bytes", gaugeSample(1, "kafka_id", "lkc-1")),
+	})
+	if err == nil {
+		t.Errorf("Expected the push to fail")
+		t.Fail()
+	}
+}
+
+func TestOnceRequiresPushgateway(t *testing.T) {
+	context := ExporterContext{Granularity: "PT1M", Mode: "query", Retry: DefaultRetryPolicy, ScrapeTimeout: 60, Once: true, Pushgateway: DefaultPushgatewayConfig}
+	if checkConfiguration(&context) == nil {
+		t.Errorf("Expected --once to require the URL of the Pushgateway")
+		t.Fail()
+	}
+}
+
+func TestCollectFamiliesReportsRuleErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, descriptorResourceURI):
+			fmt.Fprint(w, `{"data":[{"type":"kafka","labels":[{"key":"kafka.id"}]}]}`)
+		case strings.HasSuffix(r.URL.Path, descriptorURI):
+			fmt.Fprint(w, `{"data":[{"name":"io.confluent.kafka.server/retained_bytes","type":"GAUGE_INT64","labels":[{"key":"topic"}]}]}`)
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.Contains(string(body), "lkc-failing") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, `{"data":[{"timestamp":"2021-01-01T00:00:00Z","value":1.0,"metric.topic":"orders"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	labels := []string{"kafka.id", "topic"}
+	Context = ExporterContext{
+		HTTPBaseURL:   server.URL + "/",
+		Retry:         RetryPolicy{MaxAttempts: 1},
+		Granularity:   "PT1M",
+		Mode:          "query",
+		ScrapeTimeout: 10,
+		Rules: []Rule{
+			{id: 0, Clusters: []string{"lkc-1"}, Metrics: []string{"io.confluent.kafka.server/retained_bytes"}, GroupByLabels: labels},
+			// The metric is not exposed by the Metrics API, thus the rule is never queried
+			{id: 1, Clusters: []string{"lkc-1"}, Metrics: []string{"io.confluent.kafka.server/unknown"}, GroupByLabels: labels},
+			{id: 2, Clusters: []string{"lkc-failing"}, Metrics: []string{"io.confluent.kafka.server/retained_bytes"}, GroupByLabels: labels},
+		},
+	}
+	setConfiguredRules(Context.Rules)
+
+	collector := &CCloudCollector{metrics: make(map[string]CCloudCollectorMetric), cache: NewCache(0, false), store: NewMetricStore()}
+	err := collector.discover()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	families, err := collector.collectFamilies(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rule 1:") || !strings.Contains(err.Error(), "rule 2:") || strings.Contains(err.Error(), "rule 0:") {
+		t.Errorf("Expected rules 1 and 2 to be reported as failed, got %v", err)
+		t.Fail()
+	}
+	if family, present := families["ccloud_metric_retained_bytes"]; !present || len(family.GetMetric()) != 1 {
+		t.Errorf("Expected the data points of rule 0 to be returned, got %v", families)
+		t.Fail()
+	}
+}
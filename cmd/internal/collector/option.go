@@ -8,42 +8,79 @@ package collector
 //
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 var supportedGranularity = []string{"PT1M", "PT5M", "PT15M", "PT30M", "PT1H"}
+var supportedModes = []string{"query", "export"}
+
+// configFile is the path of the configuration file, kept to reload the rules
+var configFile string
+
+var errNoResource = errors.New("no cluster, connector, ksqlDB, Schema Registry or other resource ID has been specified in a rule")
 
 // ParseOption parses options provided by the CLI and the configuration file
 // This function will panic if the options are invalid
 func ParseOption() {
+	parseOptions(flag.CommandLine, os.Args[1:])
+}
+
+// parseOptions registers the options shared by all commands on a set of flags,
+// then parses the arguments and the configuration file
+func parseOptions(flags *flag.FlagSet, args []string) {
 	var clusters string
 	var connectors string
 	var ksqlApplications string
 	var schemaRegistries string
-	var configPath string
-
-	flag.StringVar(&configPath, "config", "", "Path to configuration file used to override default behavior of ccloudexporter")
-	flag.IntVar(&Context.HTTPTimeout, "timeout", 60, "Timeout, in second, to use for all REST call with the Metric API")
-	flag.StringVar(&Context.HTTPBaseURL, "endpoint", "https://api.telemetry.confluent.cloud/", "Base URL for the Metric API")
-	flag.StringVar(&Context.Granularity, "granularity", "PT1M", "Granularity for the metrics query, by default set to 1 minutes")
-	flag.IntVar(&Context.Delay, "delay", 120, "Delay, in seconds, to fetch the metrics. By default set to 120, this, in order to avoid temporary data points.")
-	flag.IntVar(&Context.CachedSecond, "cached-second", 30, "Number of second that data will be cached in-memory and returned to Prometheus. This is a mechanism to protect the MetricsAPI from being flooded.")
-	flag.StringVar(&clusters, "cluster", "", "Comma separated list of cluster ID to fetch metric for. If not specified, the environment variable CCLOUD_CLUSTER will be used")
-	flag.StringVar(&connectors, "connector", "", "Comma separated list of connector ID to fetch metric for. If not specified, the environment variable CCLOUD_CONNECTOR will be used")
-	flag.StringVar(&ksqlApplications, "ksqlDB", "", "Comma separated list of ksqlDB application to fetch metric for. If not specified, the environment variable CCLOUD_KSQL will be used")
-	flag.StringVar(&schemaRegistries, "schemaRegistry", "", "Comma separated list of Schema Registry ID to fetch metric for. If not specified, the environment variable CCLOUD_SCHEMA_REGISTRY will be used")
-	flag.StringVar(&Context.Listener, "listener", "0.0.0.0:2112", "Listener for the HTTP interface")
-	flag.BoolVar(&Context.NoTimestamp, "no-timestamp", false, "Do not propagate the timestamp from the the metrics API to prometheus")
-	versionFlag := flag.Bool("version", false, "Print the current version and exit")
-	verboseFlag := flag.Bool("verbose", false, "Print trace level logs to stdout")
-	prettyPrintLogs := flag.Bool("log-pretty-print", true, "Pretty print the JSON log output")
-
-	flag.Parse()
+	var pushgatewayURL string
+
+	flags.StringVar(&configFile, "config", "", "Path to configuration file used to override default behavior of ccloudexporter")
+	flags.IntVar(&Context.HTTPTimeout, "timeout", 60, "Timeout, in second, to use for all REST call with the Metric API")
+	flags.StringVar(&Context.HTTPBaseURL, "endpoint", "https://api.telemetry.confluent.cloud/", "Base URL for the Metric API")
+	flags.IntVar(&Context.MaxPages, "max-pages", 0, "Maximum number of pages to fetch for a single query to the Metric API, 0 means no limit")
+	flags.StringVar(&Context.Granularity, "granularity", "PT1M", "Granularity for the metrics query, by default set to 1 minutes")
+	flags.IntVar(&Context.Delay, "delay", 120, "Delay, in seconds, to fetch the metrics. By default set to 120, this, in order to avoid temporary data points.")
+	flags.IntVar(&Context.CachedSecond, "cached-second", 30, "Number of second that data will be cached in-memory and returned to Prometheus. This is a mechanism to protect the MetricsAPI from being flooded.")
+	flags.IntVar(&Context.PollInterval, "poll-interval", 0, "Interval, in second, to poll the Metrics API in the background, scrapes then only return the latest polled metrics. 0 means the Metrics API is queried on scrape")
+	flags.BoolVar(&Context.StaleWhileRevalidate, "stale-while-revalidate", false, "Return the expired cached data while the cache is refreshed in the background, so scrapes never wait for the Metrics API")
+	flags.IntVar(&Context.ScrapeTimeout, "scrape-timeout", 60, "Deadline, in second, to collect all metrics from the Metric API, including retries")
+	flags.StringVar(&clusters, "cluster", "", "Comma separated list of cluster ID to fetch metric for. If not specified, the environment variable CCLOUD_CLUSTER will be used")
+	flags.StringVar(&connectors, "connector", "", "Comma separated list of connector ID to fetch metric for. If not specified, the environment variable CCLOUD_CONNECTOR will be used")
+	flags.StringVar(&ksqlApplications, "ksqlDB", "", "Comma separated list of ksqlDB application to fetch metric for. If not specified, the environment variable CCLOUD_KSQL will be used")
+	flags.StringVar(&schemaRegistries, "schemaRegistry", "", "Comma separated list of Schema Registry ID to fetch metric for. If not specified, the environment variable CCLOUD_SCHEMA_REGISTRY will be used")
+	flags.StringVar(&Context.Mode, "mode", "query", "Endpoint of the Metric API used to fetch metrics, either query or export")
+	flags.StringVar(&Context.Listener, "listener", "0.0.0.0:2112", "Listener for the HTTP interface")
+	flags.BoolVar(&Context.FailFast, "fail-fast", false, "Exit the process on errors that are not worth retrying (e.g. invalid credentials) instead of retrying in the background")
+	flags.BoolVar(&Context.NoTimestamp, "no-timestamp", false, "Do not propagate the timestamp from the the metrics API to prometheus")
+	flags.BoolVar(&Context.Once, "once", false, "Execute every rule once, push the metrics to the Pushgateway and exit, with a non-zero status if any query failed")
+	flags.StringVar(&pushgatewayURL, "pushgateway", "", "URL of the Pushgateway the metrics are pushed to with --once, overrides config.pushgateway.url")
+	versionFlag := flags.Bool("version", false, "Print the current version and exit")
+	verboseFlag := flags.Bool("verbose", false, "Print trace level logs to stdout")
+	prettyPrintLogs := flags.Bool("log-pretty-print", true, "Pretty print the JSON log output")
+
+	flags.Parse(args)
+
+	Context.Retry = DefaultRetryPolicy
+	Context.DescriptorRefreshInterval = 3600
+	Context.Discovery = DefaultDiscoveryConfig
+	Context.Sinks.RemoteWrite = DefaultRemoteWriteConfig
+	Context.Sinks.OTLP = DefaultOTLPConfig
+	Context.Sinks.DogStatsD = DefaultDogStatsDConfig
+	Context.Sinks.InfluxDB = DefaultInfluxDBConfig
+	Context.Sinks.Graphite = DefaultGraphiteConfig
+	Context.Sinks.Splunk = DefaultSplunkHECConfig
+	Context.Sinks.File = DefaultFileConfig
+	Context.Pushgateway = DefaultPushgatewayConfig
+	Context.TopicRefreshInterval = 300
 
 	log.SetFormatter(&log.JSONFormatter{PrettyPrint: *prettyPrintLogs})
 	log.SetOutput(os.Stdout)
@@ -63,8 +100,8 @@ func ParseOption() {
 	ksqlApplications = getFromEnvIfEmpty(ksqlApplications, "CCLOUD_KSQL")
 	schemaRegistries = getFromEnvIfEmpty(schemaRegistries, "CCLOUD_SCHEMA_REGISTRY")
 
-	if configPath != "" {
-		parseConfigFile(configPath)
+	if configFile != "" {
+		parseConfigFile(configFile)
 	} else {
 		createDefaultRule(
 			splitEnv(clusters),
@@ -73,69 +110,173 @@ func ParseOption() {
 			splitEnv(schemaRegistries),
 		)
 	}
-	validateConfiguration()
+	if pushgatewayURL != "" {
+		Context.Pushgateway.URL = pushgatewayURL
+	}
+	validateConfiguration(flags)
+	setConfiguredRules(Context.Rules)
 }
 
-// MustGetAPIKey returns the API Key from environment variables
-// if an API Key can not be find, it exits the process
-func MustGetAPIKey() string {
+// GetAPIKey returns the API Key from environment variables
+// if an API Key can not be find, it returns an error
+func GetAPIKey() (string, error) {
 	key, present := os.LookupEnv("CCLOUD_API_KEY")
 	if present && key != "" {
-		return key
+		return key, nil
 	}
 
 	key, present = os.LookupEnv("CCLOUD_USER")
 	if present && key != "" {
-		return key
+		return key, nil
 	}
 
-	log.Fatalln("CCLOUD_API_KEY environment variable has not been specified")
-	panic(nil)
+	return "", errors.New("CCLOUD_API_KEY environment variable has not been specified")
 }
 
-// MustGetAPISecret returns the API Key from environment variables
-// if an API Key can not be find, it exits the process
-func MustGetAPISecret() string {
+// GetAPISecret returns the API Secret from environment variables
+// if an API Secret can not be find, it returns an error
+func GetAPISecret() (string, error) {
 	secret, present := os.LookupEnv("CCLOUD_API_SECRET")
 	if present && secret != "" {
-		return secret
+		return secret, nil
 	}
 
 	secret, present = os.LookupEnv("CCLOUD_PASSWORD")
 	if present && secret != "" {
-		return secret
+		return secret, nil
 	}
 
-	log.Fatalln("CCLOUD_API_SECRET environment variable has not been specified")
-	panic(nil)
+	return "", errors.New("CCLOUD_API_SECRET environment variable has not been specified")
+}
+
+func validateConfiguration(flags *flag.FlagSet) {
+	err := checkConfiguration(&Context)
+	if errors.Is(err, errNoResource) {
+		log.WithError(err).Errorln("Invalid configuration")
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.WithError(err).Fatalln("Invalid configuration")
+	}
 }
 
-func validateConfiguration() {
+// checkConfiguration returns an error describing the first invalid option of the context
+func checkConfiguration(context *ExporterContext) error {
+	if !contains(supportedGranularity, context.Granularity) {
+		return fmt.Errorf("granularity %s is invalid", context.Granularity)
+	}
+
+	if !contains(supportedModes, context.Mode) {
+		return fmt.Errorf("mode %s is invalid, supported modes are %s", context.Mode, supportedModes)
+	}
+
+	if err := checkRetryPolicy(context.Retry, "config.http.retry"); err != nil {
+		return err
+	}
 
-	if !contains(supportedGranularity, Context.Granularity) {
-		log.WithFields(log.Fields{"granularity": Context.Granularity}).Fatalf("Granularity %s is invalid\n", Context.Granularity)
+	if context.MaxRequestsPerSecond < 0 || context.MaxConcurrentRequests < 0 {
+		return errors.New("config.http.maxRequestsPerSecond and config.http.maxConcurrentRequests can not be negative")
 	}
 
-	for _, rule := range Context.Rules {
-		if len(rule.Clusters) == 0 && len(rule.Connectors) == 0 && len(rule.Ksql) == 0 {
-			log.Errorln("No cluster, connector, or ksqlDB ID has been specified in a rule")
-			flag.Usage()
-			os.Exit(1)
+	for _, rule := range context.Rules {
+		if context.Mode == "export" && len(rule.Aggregations) > 0 {
+			return errors.New("aggregations are not supported by the export endpoint")
 		}
+	}
+
+	if context.MaxCatchUp < 0 {
+		return errors.New("config.maxCatchUp can not be negative")
+	}
+
+	// Prometheus only ingests the latest data point of each series, the intervals caught up would be lost
+	if context.MaxCatchUp > 0 && !context.AccumulateDeltas && !context.Sinks.configured() {
+		return errors.New("config.maxCatchUp requires config.accumulateDeltas or a sink")
+	}
 
-		if contains(rule.GroupByLabels, "partition") && len(rule.Topics) == 0 {
-			log.Fatalln("Topic filtering is required while grouping per partition")
+	if context.PollInterval < 0 {
+		return errors.New("config.pollInterval can not be negative")
+	}
+
+	// Polling more often than the granularity would fetch the same data points again
+	granularity := int(GetGranularityDuration(context.Granularity).Seconds())
+	if context.PollInterval > 0 && context.PollInterval%granularity != 0 {
+		return fmt.Errorf("config.pollInterval must be a multiple of the granularity, %d seconds", granularity)
+	}
+
+	if context.ScrapeTimeout <= 0 {
+		return errors.New("the scrape timeout must be a positive number of second")
+	}
+
+	if context.Discovery.NameRegex != "" {
+		if _, err := regexp.Compile(context.Discovery.NameRegex); err != nil {
+			return fmt.Errorf("config.discovery.nameRegex is not a valid regular expression: %s", err)
 		}
+	}
+
+	if err := checkSinks(context.Sinks); err != nil {
+		return err
+	}
+
+	// Sinks are flushed after each poll, they would not receive anything without polling
+	if context.Sinks.configured() && context.PollInterval == 0 && !context.Once {
+		return errors.New("config.pollInterval is required when a sink is configured")
+	}
 
-		if len(rule.Topics) > 100 {
-			log.Errorln("A rule can not have more than 100 topics")
-			log.Fatalln("Note: Dispatching your topics over multiple rule should fix this issue")
+	if context.Once {
+		if err := checkPushgateway(context.Pushgateway); err != nil {
+			return err
+		}
+	}
+
+	return checkRules(context.Rules)
+}
+
+// checkRetryPolicy returns an error if the retry policy configured under key is invalid
+func checkRetryPolicy(policy RetryPolicy, key string) error {
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("%s.maxAttempts must be at least 1", key)
+	}
+
+	if policy.BaseBackoff <= 0 {
+		return fmt.Errorf("%s.baseBackoff must be positive", key)
+	}
+
+	if policy.MaxBackoff < policy.BaseBackoff {
+		return fmt.Errorf("%s.maxBackoff must be greater than or equal to %s.baseBackoff", key, key)
+	}
+
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("%s.jitter must be between 0 and 1", key)
+	}
+	return nil
+}
+
+// checkRules returns an error if one of the rules is invalid
+func checkRules(rules []Rule) error {
+	for _, rule := range rules {
+		// Rules relying on discovery might not define any resource
+		if len(rule.Clusters) == 0 && !rule.hasResources() && !rule.Discover {
+			return errNoResource
+		}
+
+		if contains(rule.GroupByLabels, "partition") && !rule.selectsTopics() {
+			return errors.New("topic filtering is required while grouping per partition")
+		}
+
+		if err := rule.checkTopicPatterns(); err != nil {
+			return err
+		}
+
+		if err := rule.checkAggregations(getDescribedMetrics()); err != nil {
+			return err
 		}
 
 		if len(rule.GroupByLabels) == 0 {
-			log.Fatalln("Labels is required while defining a rule")
+			return errors.New("labels is required while defining a rule")
 		}
 	}
+	return nil
 }
 
 func parseConfigFile(configPath string) {
@@ -149,29 +290,129 @@ func parseConfigFile(configPath string) {
 
 	setIntIfExit(&Context.Delay, "config.delay")
 	setIntIfExit(&Context.CachedSecond, "config.cachedSecond")
+	setBoolIfExist(&Context.StaleWhileRevalidate, "config.staleWhileRevalidate")
+	setIntIfExit(&Context.PollInterval, "config.pollInterval")
+	setIntIfExit(&Context.TopicRefreshInterval, "config.topicRefreshInterval")
+	setBoolIfExist(&Context.AccumulateDeltas, "config.accumulateDeltas")
+	setIntIfExit(&Context.MaxCatchUp, "config.maxCatchUp")
 	setStringIfExit(&Context.Granularity, "config.granularity")
 	setStringIfExit(&Context.Listener, "config.listener")
+	setStringIfExit(&Context.Mode, "config.mode")
 	setStringIfExit(&Context.HTTPBaseURL, "config.http.baseUrl")
 	setIntIfExit(&Context.HTTPTimeout, "config.http.timeout")
+	setIntIfExit(&Context.MaxPages, "config.http.maxPages")
+	setRetryPolicyIfExist(&Context.Retry, "config.http.retry")
+	setIntIfExit(&Context.ScrapeTimeout, "config.scrapeTimeout")
+	setFloatIfExist(&Context.MaxRequestsPerSecond, "config.http.maxRequestsPerSecond")
+	setIntIfExit(&Context.MaxConcurrentRequests, "config.http.maxConcurrentRequests")
 	setBoolIfExist(&Context.NoTimestamp, "config.noTimestamp")
+	setBoolIfExist(&Context.FailFast, "config.failFast")
+	setIntIfExit(&Context.DescriptorRefreshInterval, "config.descriptorRefreshInterval")
+	setStringIfExit(&Context.Discovery.BaseURL, "config.discovery.baseUrl")
+	setIntIfExit(&Context.Discovery.Interval, "config.discovery.interval")
+	setStringSliceIfExist(&Context.Discovery.Environments, "config.discovery.environments")
+	setStringIfExit(&Context.Discovery.NameRegex, "config.discovery.nameRegex")
+	setStringIfExit(&Context.Sinks.RemoteWrite.URL, "config.sinks.remoteWrite.url")
+	setIntIfExit(&Context.Sinks.RemoteWrite.BatchSize, "config.sinks.remoteWrite.batchSize")
+	setIntIfExit(&Context.Sinks.RemoteWrite.Timeout, "config.sinks.remoteWrite.timeout")
+	setStringIfExit(&Context.Sinks.RemoteWrite.Username, "config.sinks.remoteWrite.username")
+	setStringIfExit(&Context.Sinks.RemoteWrite.Password, "config.sinks.remoteWrite.password")
+	setStringIfExit(&Context.Sinks.RemoteWrite.BearerToken, "config.sinks.remoteWrite.bearerToken")
+	setRetryPolicyIfExist(&Context.Sinks.RemoteWrite.Retry, "config.sinks.remoteWrite.retry")
+	setStringIfExit(&Context.Sinks.OTLP.URL, "config.sinks.otlp.url")
+	setStringIfExit(&Context.Sinks.OTLP.Protocol, "config.sinks.otlp.protocol")
+	setStringIfExit(&Context.Sinks.OTLP.Compression, "config.sinks.otlp.compression")
+	setStringMapIfExist(&Context.Sinks.OTLP.Headers, "config.sinks.otlp.headers")
+	setIntIfExit(&Context.Sinks.OTLP.BatchSize, "config.sinks.otlp.batchSize")
+	setIntIfExit(&Context.Sinks.OTLP.Timeout, "config.sinks.otlp.timeout")
+	setRetryPolicyIfExist(&Context.Sinks.OTLP.Retry, "config.sinks.otlp.retry")
+	setStringIfExit(&Context.Sinks.DogStatsD.Address, "config.sinks.dogstatsd.address")
+	setStringIfExit(&Context.Sinks.DogStatsD.Prefix, "config.sinks.dogstatsd.prefix")
+	setStringSliceIfExist(&Context.Sinks.DogStatsD.Tags, "config.sinks.dogstatsd.tags")
+	setStringIfExit(&Context.Sinks.DogStatsD.Samples, "config.sinks.dogstatsd.samples")
+	setIntIfExit(&Context.Sinks.DogStatsD.MaxPacketSize, "config.sinks.dogstatsd.maxPacketSize")
+	setStringIfExit(&Context.Sinks.InfluxDB.URL, "config.sinks.influxdb.url")
+	setStringIfExit(&Context.Sinks.InfluxDB.Org, "config.sinks.influxdb.org")
+	setStringIfExit(&Context.Sinks.InfluxDB.Bucket, "config.sinks.influxdb.bucket")
+	setStringIfExit(&Context.Sinks.InfluxDB.Token, "config.sinks.influxdb.token")
+	setIntIfExit(&Context.Sinks.InfluxDB.BatchSize, "config.sinks.influxdb.batchSize")
+	setIntIfExit(&Context.Sinks.InfluxDB.Timeout, "config.sinks.influxdb.timeout")
+	setRetryPolicyIfExist(&Context.Sinks.InfluxDB.Retry, "config.sinks.influxdb.retry")
+	setStringIfExit(&Context.Sinks.Graphite.Address, "config.sinks.graphite.address")
+	setStringIfExit(&Context.Sinks.Graphite.Template, "config.sinks.graphite.template")
+	setStringMapIfExist(&Context.Sinks.Graphite.Templates, "config.sinks.graphite.templates")
+	setIntIfExit(&Context.Sinks.Graphite.Timeout, "config.sinks.graphite.timeout")
+	setIntIfExit(&Context.Sinks.Graphite.MaxBufferSize, "config.sinks.graphite.maxBufferSize")
+	setStringIfExit(&Context.Sinks.Splunk.URL, "config.sinks.splunk.url")
+	setStringIfExit(&Context.Sinks.Splunk.Token, "config.sinks.splunk.token")
+	setStringIfExit(&Context.Sinks.Splunk.Index, "config.sinks.splunk.index")
+	setStringIfExit(&Context.Sinks.Splunk.Source, "config.sinks.splunk.source")
+	setStringIfExit(&Context.Sinks.Splunk.Sourcetype, "config.sinks.splunk.sourcetype")
+	setStringIfExit(&Context.Sinks.Splunk.Host, "config.sinks.splunk.host")
+	setIntIfExit(&Context.Sinks.Splunk.BatchSize, "config.sinks.splunk.batchSize")
+	setIntIfExit(&Context.Sinks.Splunk.Timeout, "config.sinks.splunk.timeout")
+	setRetryPolicyIfExist(&Context.Sinks.Splunk.Retry, "config.sinks.splunk.retry")
+	setStringIfExit(&Context.Sinks.Splunk.CAFile, "config.sinks.splunk.caFile")
+	setBoolIfExist(&Context.Sinks.Splunk.InsecureSkipVerify, "config.sinks.splunk.insecureSkipVerify")
+	setBoolIfExist(&Context.Sinks.Splunk.Ack, "config.sinks.splunk.ack")
+	setIntIfExit(&Context.Sinks.Splunk.AckTimeout, "config.sinks.splunk.ackTimeout")
+	setStringIfExit(&Context.Sinks.Splunk.Channel, "config.sinks.splunk.channel")
+	setStringIfExit(&Context.Sinks.File.Path, "config.sinks.file.path")
+	setIntIfExit(&Context.Sinks.File.MaxSize, "config.sinks.file.maxSize")
+	setIntIfExit(&Context.Sinks.File.RotationInterval, "config.sinks.file.rotationInterval")
+	setBoolIfExist(&Context.Sinks.File.Compress, "config.sinks.file.compress")
+	setIntIfExit(&Context.Sinks.File.StateRetention, "config.sinks.file.stateRetention")
+	setStringIfExit(&Context.Pushgateway.URL, "config.pushgateway.url")
+	setStringIfExit(&Context.Pushgateway.Job, "config.pushgateway.job")
+	setStringMapIfExist(&Context.Pushgateway.GroupingKey, "config.pushgateway.groupingKey")
+	setStringSliceIfExist(&Context.Pushgateway.GroupBy, "config.pushgateway.groupBy")
+	setStringIfExit(&Context.Pushgateway.Username, "config.pushgateway.username")
+	setStringIfExit(&Context.Pushgateway.Password, "config.pushgateway.password")
+	setIntIfExit(&Context.Pushgateway.Timeout, "config.pushgateway.timeout")
+
+	Context.Rules, err = parseRules(viper.GetViper())
+	if err != nil {
+		log.WithError(err).Fatalln("Can not parse the rules of the configuration file")
+	}
+}
+
+// readRules reads the rules of a configuration file, without modifying the current context
+func readRules(configPath string) ([]Rule, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	v.SetConfigFile(configPath)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+	return parseRules(v)
+}
 
-	viper.UnmarshalKey("rules", &Context.Rules)
-	for i, rule := range Context.Rules {
+func parseRules(v *viper.Viper) ([]Rule, error) {
+	rules := make([]Rule, 0)
+	err := v.UnmarshalKey("rules", &rules)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range rules {
 		rule.id = i
-		Context.Rules[i] = upgradeRuleIfRequired(rule)
+		rules[i] = upgradeRuleIfRequired(rule)
 	}
+	return rules, nil
 }
 
 func createDefaultRule(clusters []string, connectors []string, ksqlDBApplications []string, schemaRegistries []string) {
 	Context.Rules = make([]Rule, 1)
 	Context.Rules[0] = Rule{
-		id:               0,
-		Clusters:         clusters,
-		Connectors:       connectors,
-		Ksql:             ksqlDBApplications,
-		SchemaRegistries: schemaRegistries,
-		Metrics:          DefaultMetrics,
-		GroupByLabels:    DefaultGroupingLabels,
+		id:       0,
+		Clusters: clusters,
+		Resources: map[string][]string{
+			"connector":       connectors,
+			"ksql":            ksqlDBApplications,
+			"schema_registry": schemaRegistries,
+		},
+		Metrics:       DefaultMetrics,
+		GroupByLabels: DefaultGroupingLabels,
 	}
 }
 
@@ -184,6 +425,23 @@ func upgradeRuleIfRequired(rule Rule) Rule {
 		}
 	}
 
+	// connectors, ksqls and schemaRegistries are shortcuts for
+	// resources.connector, resources.ksql and resources.schema_registry
+	if rule.Resources == nil {
+		rule.Resources = make(map[string][]string)
+	}
+	rule.Resources["connector"] = append(rule.Resources["connector"], rule.Connectors...)
+	rule.Resources["ksql"] = append(rule.Resources["ksql"], rule.Ksql...)
+	rule.Resources["schema_registry"] = append(rule.Resources["schema_registry"], rule.SchemaRegistries...)
+
+	for metric, aggregation := range rule.Aggregations {
+		rule.Aggregations[metric] = strings.ToUpper(aggregation)
+	}
+
+	// Kafka clusters are handled by a dedicated collector, relying on rule.Clusters
+	rule.Clusters = append(rule.Clusters, rule.Resources["kafka"]...)
+	delete(rule.Resources, "kafka")
+
 	return rule
 }
 
@@ -216,12 +474,37 @@ func setStringSliceIfExist(destination *[]string, key string) {
 	}
 }
 
+func setStringMapIfExist(destination *map[string]string, key string) {
+	if viper.Get(key) != nil {
+		*destination = viper.GetStringMapString(key)
+	}
+}
+
 func setIntIfExit(destination *int, key string) {
 	if viper.Get(key) != nil {
 		*destination = viper.GetInt(key)
 	}
 }
 
+func setFloatIfExist(destination *float64, key string) {
+	if viper.Get(key) != nil {
+		*destination = viper.GetFloat64(key)
+	}
+}
+
+func setDurationIfExist(destination *time.Duration, key string) {
+	if viper.Get(key) != nil {
+		*destination = viper.GetDuration(key)
+	}
+}
+
+func setRetryPolicyIfExist(destination *RetryPolicy, key string) {
+	setIntIfExit(&destination.MaxAttempts, key+".maxAttempts")
+	setDurationIfExist(&destination.BaseBackoff, key+".baseBackoff")
+	setDurationIfExist(&destination.MaxBackoff, key+".maxBackoff")
+	setFloatIfExist(&destination.Jitter, key+".jitter")
+}
+
 func setBoolIfExist(destination *bool, key string) {
 	if viper.Get(key) != nil {
 		*destination = viper.GetBool(key)
@@ -0,0 +1,274 @@
+package collector
+
+//
+// otlp.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OTLPConfig configures the OpenTelemetry (OTLP) sink
+type OTLPConfig struct {
+	URL         string
+	Protocol    string
+	Compression string
+	Headers     map[string]string
+	BatchSize   int
+	Timeout     int
+	Retry       RetryPolicy
+}
+
+// DefaultOTLPConfig is the default configuration of the OTLP sink
+var DefaultOTLPConfig = OTLPConfig{
+	Protocol:  "http/json",
+	BatchSize: 1000,
+	Timeout:   30,
+	Retry:     DefaultRetryPolicy,
+}
+
+// OTLPSink pushes the data points to an OTLP/HTTP endpoint, e.g. an OpenTelemetry Collector
+// Metrics keep the name they have in Prometheus, the description and unit of the Metrics API,
+// and the resource IDs (e.g. kafka.id) become the attributes of the OTLP resource
+type OTLPSink struct {
+	config OTLPConfig
+	client http.Client
+	sinkBuffer
+}
+
+// OTLP JSON encoding of an ExportMetricsServiceRequest
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+	AsInt             string          `json:"asInt,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpAggregationTemporalityDelta is AGGREGATION_TEMPORALITY_DELTA, the Metrics API returns the delta of counters over each interval
+const otlpAggregationTemporalityDelta = 1
+
+// check returns an error describing the first invalid option of the OTLP sink
+func (config OTLPConfig) check() error {
+	if _, err := url.ParseRequestURI(config.URL); err != nil {
+		return fmt.Errorf("config.sinks.otlp.url is not a valid URL: %s", err)
+	}
+
+	if config.Protocol == "grpc" {
+		return errors.New("config.sinks.otlp.protocol grpc is not supported, use http/json, e.g. with the OTLP/HTTP receiver of an OpenTelemetry Collector")
+	}
+	if config.Protocol != "http/json" {
+		return fmt.Errorf("config.sinks.otlp.protocol %s is invalid, the only supported protocol is http/json", config.Protocol)
+	}
+
+	if config.Compression != "" && config.Compression != "gzip" {
+		return fmt.Errorf("config.sinks.otlp.compression %s is invalid, supported compressions are none and gzip", config.Compression)
+	}
+
+	if config.BatchSize <= 0 || config.Timeout <= 0 {
+		return errors.New("config.sinks.otlp.batchSize and config.sinks.otlp.timeout must be positive")
+	}
+
+	return checkRetryPolicy(config.Retry, "config.sinks.otlp.retry")
+}
+
+// NewOTLPSink creates a new OTLP sink
+func NewOTLPSink(config OTLPConfig) *OTLPSink {
+	return &OTLPSink{
+		config: config,
+		client: http.Client{Timeout: time.Second * time.Duration(config.Timeout)},
+	}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *OTLPSink) Name() string {
+	return "otlp"
+}
+
+// Flush pushes the buffered data points, in batches of config.sinks.otlp.batchSize data points
+// A batch that can not be pushed after all retries is dropped
+func (sink *OTLPSink) Flush() error {
+	return sink.flush(sink.Name(), sink.config.BatchSize, sink.send)
+}
+
+// send pushes a single ExportMetricsServiceRequest
+func (sink *OTLPSink) send(points []Datapoint) error {
+	body, err := json.Marshal(newOTLPRequest(points))
+	if err != nil {
+		return err
+	}
+	if sink.config.Compression == "gzip" {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		writer.Write(body)
+		writer.Close()
+		body = buffer.Bytes()
+	}
+
+	res, resBody, err := sendToSink(&sink.client, sink.config.Retry, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", sink.config.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "ccloudexporter/"+Version)
+		if sink.config.Compression == "gzip" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		for name, value := range sink.config.Headers {
+			req.Header.Set(name, value)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("OTLP request to %s failed: %s", sink.config.URL, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d from %s (%s)", res.StatusCode, sink.config.URL, resBody)
+	}
+	log.WithFields(log.Fields{"dataPoints": len(points), "url": sink.config.URL}).Debugln("Data points have been pushed with OTLP")
+	return nil
+}
+
+// newOTLPRequest groups data points by resource, then by metric
+// Counters of the Metrics API are delta sums, other metrics are gauges
+func newOTLPRequest(points []Datapoint) otlpRequest {
+	request := otlpRequest{ResourceMetrics: make([]*otlpResourceMetrics, 0)}
+	resources := make(map[string]*otlpResourceMetrics)
+	metrics := make(map[string]*otlpMetric)
+	granularity := GetGranularityDuration(Context.Granularity)
+
+	for _, point := range points {
+		attributes := append([]otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: "ccloudexporter"}}}, otlpAttributes(point.Resource)...)
+		resourceKey := attributesKey(attributes)
+		resourceMetrics, present := resources[resourceKey]
+		if !present {
+			resourceMetrics = &otlpResourceMetrics{
+				Resource:     otlpResource{Attributes: attributes},
+				ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "ccloudexporter", Version: Version}, Metrics: make([]*otlpMetric, 0)}},
+			}
+			resources[resourceKey] = resourceMetrics
+			request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics)
+		}
+
+		metricKey := resourceKey + "\xff" + point.Name
+		metric, present := metrics[metricKey]
+		if !present {
+			metric = &otlpMetric{Name: point.Name, Description: point.Metric.Description, Unit: point.Metric.Unit}
+			if IsDeltaMetric(point.Metric) {
+				metric.Sum = &otlpSum{AggregationTemporality: otlpAggregationTemporalityDelta, IsMonotonic: true}
+			} else {
+				metric.Gauge = &otlpGauge{}
+			}
+			metrics[metricKey] = metric
+			resourceMetrics.ScopeMetrics[0].Metrics = append(resourceMetrics.ScopeMetrics[0].Metrics, metric)
+		}
+
+		timestamp := point.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+		dataPoint := otlpDataPoint{Attributes: otlpAttributes(point.Attributes)}
+		if strings.HasSuffix(point.Metric.Type, "INT64") {
+			dataPoint.AsInt = strconv.FormatInt(int64(point.Value), 10)
+		} else {
+			value := point.Value
+			dataPoint.AsDouble = &value
+		}
+
+		if metric.Sum != nil {
+			// The data point of a delta covers the whole interval starting at its timestamp
+			dataPoint.StartTimeUnixNano = strconv.FormatInt(timestamp.UnixNano(), 10)
+			dataPoint.TimeUnixNano = strconv.FormatInt(timestamp.Add(granularity).UnixNano(), 10)
+			metric.Sum.DataPoints = append(metric.Sum.DataPoints, dataPoint)
+		} else {
+			dataPoint.TimeUnixNano = strconv.FormatInt(timestamp.UnixNano(), 10)
+			metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, dataPoint)
+		}
+	}
+	return request
+}
+
+// otlpAttributes returns labels as OTLP attributes, sorted by key
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(labels))
+	for key, value := range labels {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Key < attributes[j].Key })
+	return attributes
+}
+
+func attributesKey(attributes []otlpAttribute) string {
+	parts := make([]string, 0, len(attributes))
+	for _, attribute := range attributes {
+		parts = append(parts, attribute.Key+"\xff"+attribute.Value.StringValue)
+	}
+	return strings.Join(parts, "\xff")
+}
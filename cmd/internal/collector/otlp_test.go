@@ -0,0 +1,99 @@
+package collector
+
+//
+// otlp_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPSink(t *testing.T) {
+	Context = ExporterContext{Granularity: "PT1M"}
+	var received otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Api-Key secret" || r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil || json.NewDecoder(reader).Decode(&received) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := DefaultOTLPConfig
+	config.URL = server.URL
+	config.Compression = "gzip"
+	config.Headers = map[string]string{"Authorization": "Api-Key secret"}
+	sink := NewOTLPSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	receivedBytes := MetricDescription{Name: "io.confluent.kafka.server/received_bytes", Type: "COUNTER_INT64", Unit: "By", Description: "The delta count of bytes received"}
+	retainedBytes := MetricDescription{Name: "io.confluent.kafka.server/retained_bytes", Type: "GAUGE_INT64", Unit: "By"}
+	resource := map[string]string{"kafka.id": "lkc-1"}
+	sink.Write([]Datapoint{
+		{Name: "ccloud_metric_received_bytes", Metric: receivedBytes, Resource: resource, Attributes: map[string]string{"topic": "orders"}, Value: 10, Timestamp: timestamp},
+		{Name: "ccloud_metric_retained_bytes", Metric: retainedBytes, Resource: resource, Attributes: map[string]string{"topic": "orders"}, Value: 20, Timestamp: timestamp},
+	})
+	err := sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(received.ResourceMetrics) != 1 {
+		t.Errorf("Expected a single resource, got %d", len(received.ResourceMetrics))
+		t.Fail()
+		return
+	}
+	attributes := make(map[string]string)
+	for _, attribute := range received.ResourceMetrics[0].Resource.Attributes {
+		attributes[attribute.Key] = attribute.Value.StringValue
+	}
+	if attributes["kafka.id"] != "lkc-1" || attributes["service.name"] != "ccloudexporter" {
+		t.Errorf("Unexpected resource attributes: %v", attributes)
+		t.Fail()
+	}
+
+	metrics := received.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 {
+		t.Errorf("Expected 2 metrics, got %d", len(metrics))
+		t.Fail()
+		return
+	}
+	counter := metrics[0]
+	if counter.Sum == nil || counter.Sum.AggregationTemporality != otlpAggregationTemporalityDelta || counter.Unit != "By" || counter.Description != receivedBytes.Description {
+		t.Errorf("Expected a delta sum with its unit and description, got %+v", counter)
+		t.Fail()
+	} else if point := counter.Sum.DataPoints[0]; point.AsInt != "10" || point.TimeUnixNano != "1609459260000000000" || point.Attributes[0].Key != "topic" {
+		t.Errorf("Unexpected data point: %+v", point)
+		t.Fail()
+	}
+	if metrics[1].Gauge == nil || metrics[1].Gauge.DataPoints[0].AsInt != "20" {
+		t.Errorf("Expected a gauge, got %+v", metrics[1])
+		t.Fail()
+	}
+}
+
+func TestOTLPConfig(t *testing.T) {
+	config := DefaultOTLPConfig
+	config.URL = "http://localhost:4317"
+	config.Protocol = "grpc"
+	if checkSinks(SinksConfig{OTLP: config}) == nil {
+		t.Errorf("Expected the grpc protocol to be rejected")
+		t.Fail()
+	}
+}
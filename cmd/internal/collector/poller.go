@@ -0,0 +1,186 @@
+package collector
+
+//
+// poller.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// MetricStore keeps the latest metrics collected for each rule
+// In polling mode, rules are collected in the background and Prometheus scrapes only read from the store
+type MetricStore struct {
+	mutex   sync.RWMutex
+	metrics map[int][]prometheus.Metric
+}
+
+var granularityDurations = map[string]time.Duration{
+	"PT1M":  time.Minute,
+	"PT5M":  time.Minute * 5,
+	"PT15M": time.Minute * 15,
+	"PT30M": time.Minute * 30,
+	"PT1H":  time.Hour,
+}
+
+// NewMetricStore returns an empty store
+func NewMetricStore() *MetricStore {
+	return &MetricStore{metrics: make(map[int][]prometheus.Metric)}
+}
+
+// Update replaces the metrics stored for a rule
+func (store *MetricStore) Update(ruleID int, metrics []prometheus.Metric) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.metrics[ruleID] = metrics
+}
+
+// Retain drops the metrics of the rules that are not part of the given rules, e.g. after a reload
+func (store *MetricStore) Retain(rules []Rule) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for ruleID := range store.metrics {
+		if !containsRule(rules, ruleID) {
+			delete(store.metrics, ruleID)
+		}
+	}
+}
+
+// SendToChan sends all stored metrics
+func (store *MetricStore) SendToChan(ch chan<- prometheus.Metric) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, metrics := range store.metrics {
+		sendToChan(metrics, ch)
+	}
+}
+
+// GetGranularityDuration returns the duration of a query granularity, e.g. one minute for PT1M
+func GetGranularityDuration(granularity string) time.Duration {
+	return granularityDurations[granularity]
+}
+
+// nextPollTime returns the next time, after now, aligned on the poll interval
+// e.g. with an interval of one minute, polls happen at the beginning of every minute
+func nextPollTime(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
+
+// poll collects every rule in the background, at the beginning of every poll interval
+// Each rule is polled independently, a rule still being collected is not polled again
+// until its previous collection completes
+func (cc *CCloudCollector) poll() {
+	interval := time.Second * time.Duration(Context.PollInterval)
+	inFlight := make(map[int]bool)
+	var inFlightMutex sync.Mutex
+
+	// Rules are polled as soon as the collector is ready, then at the beginning of every interval
+	next := time.Now()
+	for {
+		time.Sleep(time.Until(next))
+
+		cc.mutex.RLock()
+		ready := cc.ready
+		cc.mutex.RUnlock()
+		if !ready {
+			next = time.Now().Add(time.Second)
+			continue
+		}
+		next = nextPollTime(time.Now(), interval)
+
+		rules := Context.GetRules()
+		cc.store.Retain(rules)
+		for _, rule := range rules {
+			inFlightMutex.Lock()
+			if inFlight[rule.id] {
+				inFlightMutex.Unlock()
+				log.WithField("rule", rule.id).Warnln("Previous poll of the rule is still running, skipping this poll")
+				continue
+			}
+			inFlight[rule.id] = true
+			inFlightMutex.Unlock()
+
+			go func(rule Rule) {
+				cc.pollRule(rule)
+				inFlightMutex.Lock()
+				delete(inFlight, rule.id)
+				inFlightMutex.Unlock()
+			}(rule)
+		}
+	}
+}
+
+// pollRule collects all metrics of a rule and stores them
+func (cc *CCloudCollector) pollRule(rule Rule) {
+	metrics := make([]prometheus.Metric, 0)
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for metric := range ch {
+			metrics = append(metrics, metric)
+		}
+		close(done)
+	}()
+
+	cc.collectRule(ch, rule)
+	close(ch)
+	<-done
+
+	cc.store.Update(rule.id, metrics)
+	dispatcher.RequestFlush()
+	log.WithFields(log.Fields{"rule": rule.id, "metrics": len(metrics)}).Debugln("Rule has been polled")
+}
+
+// collectRule collects all metrics of a rule from the collectors handling it
+// Rules might be modified by a reload, thus the copy of the rule held by each collector is used
+func (cc *CCloudCollector) collectRule(ch chan<- prometheus.Metric, rule Rule) {
+	kafkaCollector, resourceCollectors, exportCollector := cc.collectors()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Context.ScrapeTimeout))
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if exportCollector != nil {
+		if collectorRule, found := findRule(exportCollector.rules, rule.id); found {
+			exportCollector.CollectRule(ctx, ch, &wg, collectorRule)
+		}
+		wg.Wait()
+		return
+	}
+
+	if kafkaCollector != nil {
+		if collectorRule, found := findRule(kafkaCollector.rules, rule.id); found {
+			kafkaCollector.CollectRule(ctx, ch, &wg, collectorRule)
+		}
+	}
+	for _, resourceCollector := range resourceCollectors {
+		if collectorRule, found := findRule(resourceCollector.rules, rule.id); found {
+			resourceCollector.CollectRule(ctx, ch, &wg, collectorRule)
+		}
+	}
+	wg.Wait()
+}
+
+// findRule returns the rule with the given id
+// Collectors keep their own copy of the rules, as they were when the collector has been created
+func findRule(rules []Rule, ruleID int) (Rule, bool) {
+	for _, rule := range rules {
+		if rule.id == ruleID {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func containsRule(rules []Rule, ruleID int) bool {
+	_, found := findRule(rules, ruleID)
+	return found
+}
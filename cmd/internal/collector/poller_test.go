@@ -0,0 +1,54 @@
+package collector
+
+//
+// poller_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNextPollTimeIsAligned(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 7, 42, 0, time.UTC)
+
+	next := nextPollTime(now, time.Minute)
+	if !next.Equal(time.Date(2021, 1, 1, 10, 8, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next poll time: %s", next)
+		t.Fail()
+	}
+
+	next = nextPollTime(now, time.Minute*5)
+	if !next.Equal(time.Date(2021, 1, 1, 10, 10, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected next poll time: %s", next)
+		t.Fail()
+	}
+}
+
+func TestMetricStoreRetainsActiveRules(t *testing.T) {
+	desc := prometheus.NewDesc("ccloud_metric_test", "help", nil, nil)
+	store := NewMetricStore()
+	store.Update(0, []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)})
+	store.Update(1, []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2)})
+	store.Update(1, []prometheus.Metric{prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 3)})
+
+	ch := make(chan prometheus.Metric, 10)
+	store.SendToChan(ch)
+	if len(ch) != 2 {
+		t.Errorf("Expected the latest metrics of each rule, got %d metrics", len(ch))
+		t.Fail()
+	}
+
+	store.Retain([]Rule{{id: 1}})
+	ch = make(chan prometheus.Metric, 10)
+	store.SendToChan(ch)
+	if len(ch) != 1 {
+		t.Errorf("Expected the metrics of removed rules to be dropped, got %d metrics", len(ch))
+		t.Fail()
+	}
+}
@@ -9,11 +9,12 @@ package collector
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -55,6 +56,19 @@ type Filter struct {
 // QueryResponse from the cloud endpoint
 type QueryResponse struct {
 	Data []map[string]interface{} `json:"data"`
+	Meta QueryMeta                `json:"meta"`
+}
+
+// QueryMeta is the metadata returned alongside the data of a query
+type QueryMeta struct {
+	Pagination Pagination `json:"pagination"`
+}
+
+// Pagination describes how to fetch the next page of a query response
+// The next_page_token is empty on the last page
+type Pagination struct {
+	PageSize      int    `json:"page_size"`
+	NextPageToken string `json:"next_page_token"`
 }
 
 // Actual data point from the query response
@@ -70,8 +84,28 @@ type QueryResponse struct {
 
 var (
 	queryURI = "v2/metrics/cloud/query"
+	// maxTopicsPerQuery is the maximum number of topics the Metrics API accepts in the filter of a query
+	maxTopicsPerQuery = 100
 )
 
+// BuildQueries creates the queries for a metric, splitting the topic filtering in multiple
+// queries if it exceeds the number of topics accepted by the Metrics API in a single query
+func BuildQueries(metric MetricDescription, clusters []string, groupByLabels []string, topicFiltering []string, resource ResourceDescription) []Query {
+	if len(topicFiltering) <= maxTopicsPerQuery {
+		return []Query{BuildQuery(metric, clusters, groupByLabels, topicFiltering, resource)}
+	}
+
+	queries := make([]Query, 0, (len(topicFiltering)+maxTopicsPerQuery-1)/maxTopicsPerQuery)
+	for start := 0; start < len(topicFiltering); start += maxTopicsPerQuery {
+		end := start + maxTopicsPerQuery
+		if end > len(topicFiltering) {
+			end = len(topicFiltering)
+		}
+		queries = append(queries, BuildQuery(metric, clusters, groupByLabels, topicFiltering[start:end], resource))
+	}
+	return queries
+}
+
 // BuildQuery creates a new Query for a metric for a specific cluster and time interval
 // This function will return the main global query, override queries will not be generated
 func BuildQuery(metric MetricDescription, clusters []string, groupByLabels []string, topicFiltering []string, resource ResourceDescription) Query {
@@ -143,55 +177,10 @@ func BuildQuery(metric MetricDescription, clusters []string, groupByLabels []str
 	}
 }
 
-// BuildConnectorsQuery creates a new Query for a metric for a set of connectors
-// This function will return the main global query, override queries will not be generated
-func BuildConnectorsQuery(metric MetricDescription, connectors []string, resource ResourceDescription) Query {
-	timeFrom := time.Now().Add(time.Duration(-Context.Delay) * time.Second)  // the last minute might contains data that is not yet finalized
-	timeFrom = timeFrom.Add(time.Duration(-timeFrom.Second()) * time.Second) // the seconds need to be stripped to have an effective delay
-
-	aggregation := Aggregation{
-		Metric: metric.Name,
-	}
-
-	filters := make([]Filter, 0)
-
-	connectorFilters := make([]Filter, 0)
-	for _, connector := range connectors {
-		connectorFilters = append(connectorFilters, Filter{
-			Field: "resource.connector.id",
-			Op:    "EQ",
-			Value: connector,
-		})
-	}
-
-	filters = append(filters, Filter{
-		Op:      "OR",
-		Filters: connectorFilters,
-	})
-
-	filterHeader := FilterHeader{
-		Op:      "AND",
-		Filters: filters,
-	}
-
-	groupBy := make([]string, len(resource.Labels))
-	for i, rsrcLabel := range resource.Labels {
-		groupBy[i] = "resource." + rsrcLabel.Key
-	}
-
-	return Query{
-		Aggreations: []Aggregation{aggregation},
-		Filter:      filterHeader,
-		Granularity: Context.Granularity,
-		GroupBy:     groupBy,
-		Limit:       1000,
-		Intervals:   []string{fmt.Sprintf("%s/%s", timeFrom.Format(time.RFC3339), Context.Granularity)},
-	}
-}
-
-// BuildKsqlQuery creates a new Query for a metric for a specific ksql application
+// BuildResourceQuery creates a new Query for a metric for a set of resources of the same type
+// (e.g. connectors, ksqlDB applications). Resources are filtered on the ID label of the resource type.
 // This function will return the main global query, override queries will not be generated
-func BuildKsqlQuery(metric MetricDescription, ksqlAppIds []string, resource ResourceDescription) Query {
+func BuildResourceQuery(metric MetricDescription, resourceIDs []string, resource ResourceDescription) Query {
 	timeFrom := time.Now().Add(time.Duration(-Context.Delay) * time.Second)  // the last minute might contains data that is not yet finalized
 	timeFrom = timeFrom.Add(time.Duration(-timeFrom.Second()) * time.Second) // the seconds need to be stripped to have an effective delay
 
@@ -201,18 +190,18 @@ func BuildKsqlQuery(metric MetricDescription, ksqlAppIds []string, resource Reso
 
 	filters := make([]Filter, 0)
 
-	connectorFilters := make([]Filter, 0)
-	for _, ksqlID := range ksqlAppIds {
-		connectorFilters = append(connectorFilters, Filter{
-			Field: "resource.ksql.id",
+	resourceFilters := make([]Filter, 0)
+	for _, resourceID := range resourceIDs {
+		resourceFilters = append(resourceFilters, Filter{
+			Field: "resource." + resource.idLabel(),
 			Op:    "EQ",
-			Value: ksqlID,
+			Value: resourceID,
 		})
 	}
 
 	filters = append(filters, Filter{
 		Op:      "OR",
-		Filters: connectorFilters,
+		Filters: resourceFilters,
 	})
 
 	filterHeader := FilterHeader{
@@ -235,79 +224,76 @@ func BuildKsqlQuery(metric MetricDescription, ksqlAppIds []string, resource Reso
 	}
 }
 
-// BuildSchemaRegistryQuery creates a new Query for a metric for a specific schema registry id
-// This function will return the main global query, override queries will not be generated
-func BuildSchemaRegistryQuery(metric MetricDescription, schemaregistries []string, resource ResourceDescription) Query {
-	timeFrom := time.Now().Add(time.Duration(-Context.Delay) * time.Second)  // the last minute might contains data that is not yet finalized
-	timeFrom = timeFrom.Add(time.Duration(-timeFrom.Second()) * time.Second) // the seconds need to be stripped to have an effective delay
-
-	aggregation := Aggregation{
-		Metric: metric.Name,
-	}
-
-	filters := make([]Filter, 0)
-
-	connectorFilters := make([]Filter, 0)
-	for _, schemaRegistryID := range schemaregistries {
-		connectorFilters = append(connectorFilters, Filter{
-			Field: "resource.schema_registry.id",
-			Op:    "EQ",
-			Value: schemaRegistryID,
-		})
-	}
-
-	filters = append(filters, Filter{
-		Op:      "OR",
-		Filters: connectorFilters,
-	})
-
-	filterHeader := FilterHeader{
-		Op:      "AND",
-		Filters: filters,
-	}
+// SendQuery sends a query to Confluent Cloud API metrics and wait for the response synchronously
+// If the response is paginated, all pages are fetched and merged, up to Context.MaxPages pages
+// While backfilling, an error is returned instead of a truncated response
+func SendQuery(ctx context.Context, query Query) (QueryResponse, error) {
+	response := QueryResponse{}
+	pageToken := ""
+	for page := 1; ; page++ {
+		pageResponse, err := sendQueryPage(ctx, query, pageToken)
+		if err != nil {
+			return response, err
+		}
+		pagesFetched.Inc()
+		response.Data = append(response.Data, pageResponse.Data...)
+		response.Meta = pageResponse.Meta
 
-	groupBy := make([]string, len(resource.Labels))
-	for i, rsrcLabel := range resource.Labels {
-		groupBy[i] = "resource." + rsrcLabel.Key
-	}
+		pageToken = pageResponse.Meta.Pagination.NextPageToken
+		if pageToken == "" {
+			return response, nil
+		}
 
-	return Query{
-		Aggreations: []Aggregation{aggregation},
-		Filter:      filterHeader,
-		Granularity: Context.Granularity,
-		GroupBy:     groupBy,
-		Limit:       1000,
-		Intervals:   []string{fmt.Sprintf("%s/%s", timeFrom.Format(time.RFC3339), Context.Granularity)},
+		if Context.MaxPages > 0 && page >= Context.MaxPages {
+			// A truncated range would be recorded as backfilled, thus it is never fetched again
+			if _, backfilling := getBackfillWindow(ctx); backfilling {
+				return response, fmt.Errorf("the response has more than %d pages, increase `config.http.maxPages` or reduce -chunk", Context.MaxPages)
+			}
+			truncatedQueries.Inc()
+			log.WithFields(log.Fields{
+				"query":    query,
+				"maxPages": Context.MaxPages,
+				"reasons":  "The response has been truncated, you should probably increase `config.http.maxPages` or narrow down the rule",
+			}).Warnln("Maximum number of pages reached for a query")
+			return response, nil
+		}
 	}
 }
 
-// SendQuery sends a query to Confluent Cloud API metrics and wait for the response synchronously
-func SendQuery(query Query) (QueryResponse, error) {
+func sendQueryPage(ctx context.Context, query Query, pageToken string) (QueryResponse, error) {
 	jsonQuery, err := json.Marshal(query)
 	if err != nil {
 		log.WithError(err).Errorln("Failed serialize query in JSON")
 		return QueryResponse{}, errors.New("failed serializing query in JSON")
 	}
 	endpoint := Context.HTTPBaseURL + queryURI
-	req := MustGetNewRequest("POST", endpoint, bytes.NewBuffer(jsonQuery))
+	if pageToken != "" {
+		endpoint += "?page_token=" + url.QueryEscape(pageToken)
+	}
 
-	res, err := httpClient.Do(req)
+	res, body, err := SendWithRetry(ctx, func() (*http.Request, error) {
+		return NewRequest("POST", endpoint, bytes.NewBuffer(jsonQuery))
+	})
 	if err != nil {
 		log.WithError(err).Errorln("Failed to send query")
 		return QueryResponse{}, err
 	}
 
 	if res.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(res.Body)
 		if IsFatal(res) {
-			log.WithFields(log.Fields{"StatusCode": res.StatusCode, "Endpoint": endpoint, "body": string(body)}).Fatalln("Stopping the exporter due to fatal issue while querying the Metrics API")
+			fields := log.Fields{"StatusCode": res.StatusCode, "Endpoint": endpoint, "body": string(body)}
+			if Context.FailFast {
+				log.WithFields(fields).Fatalln("Stopping the exporter due to fatal issue while querying the Metrics API")
+			}
+			log.WithFields(fields).Errorln("Received a response that is not worth retrying, the API key might be invalid or revoked")
+			return QueryResponse{}, fmt.Errorf("received status code %d instead of 200 for POST on %s (%s)", res.StatusCode, endpoint, string(body))
 		}
 		if res.StatusCode == 429 {
 			log.WithFields(log.Fields{
 				"StatusCode": res.StatusCode,
 				"Endpoint":   endpoint,
 				"body":       string(body),
-				"reasons":    "You probably scrape the ccloudexporter too frequently, you should probably increase Prometheus `scrape_interval`",
+				"reasons":    "You probably scrape the ccloudexporter too frequently, you should probably increase Prometheus `scrape_interval` or `config.http.retry.maxAttempts`",
 			}).Errorln("Received invalid response")
 			errorMsg := fmt.Sprintf("Received status code %d instead of 200 for POST on %s (%s). It generally means that you scrape too frequently, you should probably increase Prometheus `scrape_interval`", res.StatusCode, endpoint, string(body))
 			return QueryResponse{}, errors.New(errorMsg)
@@ -317,15 +303,13 @@ func SendQuery(query Query) (QueryResponse, error) {
 		return QueryResponse{}, errors.New(errorMsg)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	response := QueryResponse{}
+	err = json.Unmarshal(body, &response)
 	if err != nil {
-		log.WithError(err).Errorln("Can not read response")
+		log.WithError(err).Errorln("Can not decode response")
 		return QueryResponse{}, err
 	}
 
-	response := QueryResponse{}
-	json.Unmarshal(body, &response)
-
 	return response, nil
 }
 
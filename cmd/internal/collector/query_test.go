@@ -7,10 +7,19 @@ package collector
 // Distributed under terms of the MIT license.
 //
 
+import "context"
+import "fmt"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "reflect"
 import "testing"
 import "strings"
 import "time"
 
+import "github.com/prometheus/client_golang/prometheus"
+import dto "github.com/prometheus/client_model/go"
+
 var (
 	resource = ResourceDescription{
 		Type:        "kafka",
@@ -104,6 +113,42 @@ func TestBuildQueryWithTopic(t *testing.T) {
 	}
 }
 
+func TestBuildQueriesSplitsTopics(t *testing.T) {
+	metric := MetricDescription{
+		Name:   "io.confluent.kafka.server/retained_bytes",
+		Labels: []MetricLabel{{Key: "topic"}, {Key: "kafka_id"}},
+	}
+
+	topics := make([]string, 0)
+	for i := 0; i < 250; i++ {
+		topics = append(topics, fmt.Sprintf("topic-%d", i))
+	}
+
+	queries := BuildQueries(metric, []string{"cluster"}, []string{"kafka_id", "topic"}, topics, resource)
+	if len(queries) != 3 {
+		t.Errorf("Expected 3 queries, got %d", len(queries))
+		t.Fail()
+		return
+	}
+
+	filteredTopics := make([]string, 0)
+	for _, query := range queries {
+		topicFilters := query.Filter.Filters[1].Filters
+		if len(topicFilters) > maxTopicsPerQuery {
+			t.Errorf("Query has %d topics, more than the limit", len(topicFilters))
+			t.Fail()
+		}
+		for _, filter := range topicFilters {
+			filteredTopics = append(filteredTopics, filter.Value)
+		}
+	}
+
+	if !reflect.DeepEqual(filteredTopics, topics) {
+		t.Errorf("Every topic should be filtered exactly once")
+		t.Fail()
+	}
+}
+
 func TestOptimizationRemoveSuperfelousGroupBy(t *testing.T) {
 	metric := MetricDescription{
 		Name: "io.confluent.kafka.server/retained_bytes",
@@ -145,3 +190,77 @@ func TestOptimizationDoesNotRemoveRequiredGroupBy(t *testing.T) {
 		return
 	}
 }
+
+func TestSendQueryFollowsPagination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page_token") {
+		case "":
+			fmt.Fprint(w, `{"data": [{"value": 1.0}], "meta": {"pagination": {"page_size": 1, "next_page_token": "page2"}}}`)
+		case "page2":
+			fmt.Fprint(w, `{"data": [{"value": 2.0}], "meta": {"pagination": {"page_size": 1, "next_page_token": "page3"}}}`)
+		default:
+			fmt.Fprint(w, `{"data": [{"value": 3.0}], "meta": {"pagination": {"page_size": 1}}}`)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", MaxPages: 10}
+
+	response, err := SendQuery(context.Background(), Query{})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(response.Data) != 3 {
+		t.Errorf("Expected 3 data points from 3 pages, got %d", len(response.Data))
+		t.Fail()
+		return
+	}
+}
+
+func counterValue(counter prometheus.Counter) float64 {
+	metric := dto.Metric{}
+	counter.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestSendQueryStopsAtMaxPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [{"value": 1.0}], "meta": {"pagination": {"page_size": 1, "next_page_token": "next"}}}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", MaxPages: 2}
+
+	truncated := counterValue(truncatedQueries)
+	response, err := SendQuery(context.Background(), Query{})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(response.Data) != 2 {
+		t.Errorf("Expected the response to be truncated at 2 pages, got %d data points", len(response.Data))
+		t.Fail()
+		return
+	}
+	if counterValue(truncatedQueries) != truncated+1 {
+		t.Errorf("Expected the truncation to be counted")
+		t.Fail()
+	}
+
+	// A truncated response would leave a hole in a backfill
+	ctx := withBackfillWindow(context.Background(), timeWindow{start: time.Now().Add(-time.Hour), end: time.Now()})
+	_, err = SendQuery(ctx, Query{})
+	if err == nil {
+		t.Errorf("Expected the truncation to fail the backfill")
+		t.Fail()
+	}
+}
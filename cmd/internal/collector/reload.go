@@ -0,0 +1,140 @@
+package collector
+
+//
+// reload.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// reloadMutex serializes the reloads, as they can be triggered concurrently
+// by a signal, the file watcher and the HTTP endpoint
+var reloadMutex sync.Mutex
+
+// Reload reads the rules of the configuration file again and recreates the collectors
+// Only the rules are reloaded, other options require a restart of the exporter
+// If the new rules are invalid, the current rules are kept and an error is returned
+func (cc *CCloudCollector) Reload() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	err := cc.reload()
+	if err != nil {
+		configLastReloadSuccess.Set(0)
+		log.WithError(err).WithField("config", configFile).Errorln("Can not reload the configuration, previous rules are kept")
+		return err
+	}
+
+	configLastReloadSuccess.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (cc *CCloudCollector) reload() error {
+	if configFile == "" {
+		return errors.New("no configuration file has been provided with -config")
+	}
+
+	rules, err := readRules(configFile)
+	if err != nil {
+		return err
+	}
+	// The rules are validated along with the other options, as some options restrict the rules
+	candidate := Context.withRules(rules)
+	err = checkConfiguration(&candidate)
+	if err != nil {
+		return err
+	}
+
+	// configuredRules are only replaced by a successful reload, thus a retry of a failed reload is not skipped
+	discoveryMutex.Lock()
+	previousRules := configuredRules
+	discoveryMutex.Unlock()
+	if reflect.DeepEqual(rules, previousRules) {
+		log.WithField("config", configFile).Debugln("Rules have not changed, nothing to reload")
+		return nil
+	}
+
+	err = cc.applyRules(rules)
+	if err != nil {
+		// The collectors have not been recreated, they still collect the previous rules
+		setConfiguredRules(previousRules)
+		refreshResolvedTopics()
+		return err
+	}
+
+	log.WithField("config", configFile).Infoln("Configuration has been reloaded")
+	return nil
+}
+
+// applyRules replaces the rules defined by the user and recreates the collectors for them
+func (cc *CCloudCollector) applyRules(rules []Rule) error {
+	setConfiguredRules(rules)
+	if isDiscoveryConfigured() {
+		_, err := refreshDiscoveredResources()
+		if err != nil {
+			log.WithError(err).Errorln("Can not discover the resources of the organization, previously discovered resources are used")
+		}
+	}
+	refreshResolvedTopics()
+
+	cc.mutex.RLock()
+	ready := cc.ready
+	cc.mutex.RUnlock()
+	// Until the collector is ready, the descriptor discovery picks up the new rules by itself
+	if !ready {
+		return nil
+	}
+	return cc.discover()
+}
+
+// WatchConfiguration reloads the configuration on SIGHUP and whenever the configuration file is modified
+func (cc *CCloudCollector) WatchConfiguration() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Infoln("Received SIGHUP, reloading the configuration")
+			cc.Reload()
+		}
+	}()
+
+	if configFile == "" {
+		return
+	}
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		log.WithField("event", event.String()).Infoln("Configuration file has been modified, reloading the configuration")
+		cc.Reload()
+	})
+	viper.WatchConfig()
+}
+
+// ReloadHandler is the HTTP handler reloading the configuration, only POST requests are accepted
+func (cc *CCloudCollector) ReloadHandler(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "Only POST requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := cc.Reload()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
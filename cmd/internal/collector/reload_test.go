@@ -0,0 +1,178 @@
+package collector
+
+//
+// reload_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadSwapsRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile = filepath.Join(dir, "config.yaml")
+	defer func() { configFile = "" }()
+
+	Context = ExporterContext{Granularity: "PT1M", Mode: "query", Retry: DefaultRetryPolicy, ScrapeTimeout: 60}
+	setConfiguredRules([]Rule{{Clusters: []string{"lkc-1"}, Metrics: []string{"io.confluent.kafka.server/received_bytes"}, GroupByLabels: []string{"kafka.id"}}})
+	collector := &CCloudCollector{cache: NewCache(0, false)}
+
+	ioutil.WriteFile(configFile, []byte(`
+rules:
+  - clusters:
+      - lkc-2
+    metrics:
+      - io.confluent.kafka.server/sent_bytes
+    labels:
+      - kafka.id
+`), 0644)
+	err = collector.Reload()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	rules := Context.GetRules()
+	if len(rules) != 1 || len(rules[0].Clusters) != 1 || rules[0].Clusters[0] != "lkc-2" {
+		t.Errorf("Rules have not been reloaded: %+v", rules)
+		t.Fail()
+	}
+
+	// Labels are mandatory, the invalid rules must not be applied
+	ioutil.WriteFile(configFile, []byte(`
+rules:
+  - clusters:
+      - lkc-3
+    metrics:
+      - io.confluent.kafka.server/sent_bytes
+`), 0644)
+	err = collector.Reload()
+	if err == nil {
+		t.Errorf("Expected the reload of an invalid configuration to fail")
+		t.Fail()
+	}
+
+	rules = Context.GetRules()
+	if len(rules) != 1 || rules[0].Clusters[0] != "lkc-2" {
+		t.Errorf("Previous rules should have been kept: %+v", rules)
+		t.Fail()
+	}
+
+	// Rules are valid on their own, but the export endpoint does not support aggregations
+	Context.Mode = "export"
+	ioutil.WriteFile(configFile, []byte(`
+rules:
+  - clusters:
+      - lkc-4
+    metrics:
+      - io.confluent.kafka.server/retained_bytes
+    labels:
+      - kafka.id
+    aggregations:
+      io.confluent.kafka.server/retained_bytes: MAX
+`), 0644)
+	err = collector.Reload()
+	if err == nil {
+		t.Errorf("Expected the reload of rules rejected by the configuration to fail")
+		t.Fail()
+	}
+	if rules = Context.GetRules(); rules[0].Clusters[0] != "lkc-2" {
+		t.Errorf("Previous rules should have been kept: %+v", rules)
+		t.Fail()
+	}
+}
+
+func TestReloadRestoresRulesWhenDiscoveryFails(t *testing.T) {
+	var available int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case atomic.LoadInt32(&available) == 0:
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasSuffix(r.URL.Path, descriptorResourceURI):
+			fmt.Fprint(w, `{"data":[{"type":"kafka","labels":[{"key":"kafka.id"}]}]}`)
+		default:
+			fmt.Fprint(w, `{"data":[{"name":"io.confluent.kafka.server/sent_bytes","type":"COUNTER_INT64","description":"The delta count of bytes sent","labels":[{"key":"topic"}]}]}`)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ccloudexporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile = filepath.Join(dir, "config.yaml")
+	defer func() { configFile = "" }()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", Granularity: "PT1M", Mode: "query", Retry: RetryPolicy{MaxAttempts: 1, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}, ScrapeTimeout: 10}
+	initHTTPClient()
+	setConfiguredRules([]Rule{{Clusters: []string{"lkc-1"}, Metrics: []string{"io.confluent.kafka.server/sent_bytes"}, GroupByLabels: []string{"kafka.id"}}})
+	collector := &CCloudCollector{cache: NewCache(0, false), ready: true}
+
+	ioutil.WriteFile(configFile, []byte(`
+rules:
+  - clusters:
+      - lkc-2
+    metrics:
+      - io.confluent.kafka.server/sent_bytes
+    labels:
+      - kafka.id
+`), 0644)
+	err = collector.Reload()
+	if err == nil {
+		t.Errorf("Expected the reload to fail while the collectors can not be recreated")
+		t.Fail()
+		return
+	}
+	if rules := Context.GetRules(); rules[0].Clusters[0] != "lkc-1" {
+		t.Errorf("Previous rules should have been restored: %+v", rules)
+		t.Fail()
+	}
+
+	// The same file is reloaded once the Metrics API is available, it must not be considered unchanged
+	atomic.StoreInt32(&available, 1)
+	err = collector.Reload()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+	if rules := Context.GetRules(); rules[0].Clusters[0] != "lkc-2" {
+		t.Errorf("Rules have not been reloaded: %+v", rules)
+		t.Fail()
+	}
+	if len(collector.rules) != 1 || collector.rules[0].Clusters[0] != "lkc-2" {
+		t.Errorf("Collectors have not been recreated with the new rules: %+v", collector.rules)
+		t.Fail()
+	}
+}
+
+func TestReloadHandlerOnlyAcceptsPost(t *testing.T) {
+	collector := &CCloudCollector{cache: NewCache(0, false)}
+
+	recorder := httptest.NewRecorder()
+	collector.ReloadHandler(recorder, httptest.NewRequest("GET", "/-/reload", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %d", recorder.Code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,209 @@
+package collector
+
+//
+// remote_write.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteConfig configures the Prometheus remote_write sink
+type RemoteWriteConfig struct {
+	URL         string
+	BatchSize   int
+	Timeout     int
+	Username    string
+	Password    string
+	BearerToken string
+	Retry       RetryPolicy
+}
+
+// DefaultRemoteWriteConfig is the default configuration of the remote_write sink
+var DefaultRemoteWriteConfig = RemoteWriteConfig{
+	BatchSize: 500,
+	Timeout:   30,
+	Retry:     DefaultRetryPolicy,
+}
+
+// String returns the configuration with the credentials redacted, as it is logged on startup
+func (config RemoteWriteConfig) String() string {
+	type plain RemoteWriteConfig
+	config.Password = redact(config.Password)
+	config.BearerToken = redact(config.BearerToken)
+	return fmt.Sprintf("%+v", plain(config))
+}
+
+// check returns an error describing the first invalid option of the remote_write sink
+func (config RemoteWriteConfig) check() error {
+	if _, err := url.ParseRequestURI(config.URL); err != nil {
+		return fmt.Errorf("config.sinks.remoteWrite.url is not a valid URL: %s", err)
+	}
+
+	if config.BatchSize <= 0 || config.Timeout <= 0 {
+		return errors.New("config.sinks.remoteWrite.batchSize and config.sinks.remoteWrite.timeout must be positive")
+	}
+
+	if config.BearerToken != "" && config.Username != "" {
+		return errors.New("config.sinks.remoteWrite.bearerToken and config.sinks.remoteWrite.username can not be both set")
+	}
+
+	return checkRetryPolicy(config.Retry, "config.sinks.remoteWrite.retry")
+}
+
+// RemoteWriteSink pushes the data points to a Prometheus remote_write endpoint,
+// e.g. Prometheus with --web.enable-remote-write-receiver, Cortex, Thanos or Mimir
+type RemoteWriteSink struct {
+	config RemoteWriteConfig
+	client http.Client
+	sinkBuffer
+}
+
+// remoteWriteSeries is a time series of a remote_write WriteRequest
+type remoteWriteSeries struct {
+	labels  []remoteWriteLabel
+	samples []Datapoint
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// NewRemoteWriteSink creates a new remote_write sink
+func NewRemoteWriteSink(config RemoteWriteConfig) *RemoteWriteSink {
+	return &RemoteWriteSink{
+		config: config,
+		client: http.Client{Timeout: time.Second * time.Duration(config.Timeout)},
+	}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *RemoteWriteSink) Name() string {
+	return "remoteWrite"
+}
+
+// Flush pushes the buffered data points, in batches of config.sinks.remoteWrite.batchSize data points
+// A batch that can not be pushed after all retries is dropped
+func (sink *RemoteWriteSink) Flush() error {
+	return sink.flush(sink.Name(), sink.config.BatchSize, sink.send)
+}
+
+// send pushes a single WriteRequest
+func (sink *RemoteWriteSink) send(points []Datapoint) error {
+	body := snappy.Encode(nil, encodeWriteRequest(points))
+	res, resBody, err := sendToSink(&sink.client, sink.config.Retry, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", sink.config.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("User-Agent", "ccloudexporter/"+Version)
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if sink.config.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+sink.config.BearerToken)
+		} else if sink.config.Username != "" {
+			req.SetBasicAuth(sink.config.Username, sink.config.Password)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("remote_write request to %s failed: %s", sink.config.URL, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d from %s (%s)", res.StatusCode, sink.config.URL, resBody)
+	}
+	log.WithFields(log.Fields{"samples": len(points), "url": sink.config.URL}).Debugln("Samples have been pushed with remote_write")
+	return nil
+}
+
+// groupSeries groups data points by time series, the labels of a series are sorted by name as
+// required by remote_write, and the samples of a series are sorted by timestamp
+func groupSeries(points []Datapoint) []*remoteWriteSeries {
+	seriesByKey := make(map[string]*remoteWriteSeries)
+	keys := make([]string, 0)
+	for _, point := range points {
+		labels := []remoteWriteLabel{{name: "__name__", value: point.Name}}
+		for name, value := range point.Labels {
+			labels = append(labels, remoteWriteLabel{name: name, value: value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		parts := make([]string, 0, len(labels))
+		for _, label := range labels {
+			parts = append(parts, label.name+"\xff"+label.value)
+		}
+		key := strings.Join(parts, "\xff")
+		series, present := seriesByKey[key]
+		if !present {
+			series = &remoteWriteSeries{labels: labels}
+			seriesByKey[key] = series
+			keys = append(keys, key)
+		}
+		series.samples = append(series.samples, point)
+	}
+
+	result := make([]*remoteWriteSeries, 0, len(keys))
+	for _, key := range keys {
+		series := seriesByKey[key]
+		sort.SliceStable(series.samples, func(i, j int) bool {
+			return series.samples[i].Timestamp.Before(series.samples[j].Timestamp)
+		})
+		result = append(result, series)
+	}
+	return result
+}
+
+// encodeWriteRequest encodes data points as a remote_write WriteRequest protobuf message
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(points []Datapoint) []byte {
+	var request []byte
+	for _, series := range groupSeries(points) {
+		var encodedSeries []byte
+		for _, label := range series.labels {
+			var encodedLabel []byte
+			encodedLabel = protowire.AppendTag(encodedLabel, 1, protowire.BytesType)
+			encodedLabel = protowire.AppendString(encodedLabel, label.name)
+			encodedLabel = protowire.AppendTag(encodedLabel, 2, protowire.BytesType)
+			encodedLabel = protowire.AppendString(encodedLabel, label.value)
+			encodedSeries = protowire.AppendTag(encodedSeries, 1, protowire.BytesType)
+			encodedSeries = protowire.AppendBytes(encodedSeries, encodedLabel)
+		}
+		for _, sample := range series.samples {
+			timestamp := sample.Timestamp
+			if timestamp.IsZero() {
+				timestamp = time.Now()
+			}
+			var encodedSample []byte
+			encodedSample = protowire.AppendTag(encodedSample, 1, protowire.Fixed64Type)
+			encodedSample = protowire.AppendFixed64(encodedSample, math.Float64bits(sample.Value))
+			encodedSample = protowire.AppendTag(encodedSample, 2, protowire.VarintType)
+			encodedSample = protowire.AppendVarint(encodedSample, uint64(timestamp.UnixNano()/int64(time.Millisecond)))
+			encodedSeries = protowire.AppendTag(encodedSeries, 2, protowire.BytesType)
+			encodedSeries = protowire.AppendBytes(encodedSeries, encodedSample)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, encodedSeries)
+	}
+	return request
+}
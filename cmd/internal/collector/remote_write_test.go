@@ -0,0 +1,216 @@
+package collector
+
+//
+// remote_write_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries is a time series decoded from a WriteRequest
+type decodedSeries struct {
+	labels     map[string]string
+	values     []float64
+	timestamps []int64
+}
+
+// decodeMessage returns the fields of a protobuf message, by field number
+func decodeMessage(t *testing.T, message []byte) map[protowire.Number][][]byte {
+	fields := make(map[protowire.Number][][]byte)
+	for len(message) > 0 {
+		number, fieldType, n := protowire.ConsumeTag(message)
+		message = message[n:]
+		var value []byte
+		if fieldType == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(message)
+		} else {
+			n = protowire.ConsumeFieldValue(number, fieldType, message)
+			value = message[:n]
+		}
+		if n < 0 {
+			t.Fatalf("Invalid protobuf message")
+		}
+		fields[number] = append(fields[number], value)
+		message = message[n:]
+	}
+	return fields
+}
+
+func decodeWriteRequest(t *testing.T, request []byte) []decodedSeries {
+	result := make([]decodedSeries, 0)
+	for _, encodedSeries := range decodeMessage(t, request)[1] {
+		series := decodedSeries{labels: make(map[string]string)}
+		fields := decodeMessage(t, encodedSeries)
+		for _, encodedLabel := range fields[1] {
+			label := decodeMessage(t, encodedLabel)
+			series.labels[string(label[1][0])] = string(label[2][0])
+		}
+		for _, encodedSample := range fields[2] {
+			sample := decodeMessage(t, encodedSample)
+			value, _ := protowire.ConsumeFixed64(sample[1][0])
+			timestamp, _ := protowire.ConsumeVarint(sample[2][0])
+			series.values = append(series.values, math.Float64frombits(value))
+			series.timestamps = append(series.timestamps, int64(timestamp))
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+func TestRemoteWriteSink(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	received := make([]decodedSeries, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		// The first request fails, it must be retried
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "user" || password != "secret" || r.Header.Get("Content-Encoding") != "snappy" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		compressed, _ := ioutil.ReadAll(r.Body)
+		request, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, decodeWriteRequest(t, request)...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	config := DefaultRemoteWriteConfig
+	config.URL = server.URL
+	config.BatchSize = 2
+	config.Username = "user"
+	config.Password = "secret"
+	config.Retry = RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	sink := NewRemoteWriteSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.Write([]Datapoint{
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders"}, Value: 10, Timestamp: timestamp},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders"}, Value: 20, Timestamp: timestamp.Add(time.Minute)},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "payments"}, Value: 5, Timestamp: timestamp},
+	})
+	err := sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	// 2 batches, the first one being retried
+	if requests != 3 || len(received) != 2 {
+		t.Errorf("Expected 3 requests and 2 series, got %d requests and %d series", requests, len(received))
+		t.Fail()
+		return
+	}
+
+	orders := received[0]
+	if orders.labels["__name__"] != "ccloud_metric_received_bytes" || orders.labels["topic"] != "orders" {
+		t.Errorf("Unexpected labels: %v", orders.labels)
+		t.Fail()
+	}
+	if len(orders.values) != 2 || orders.values[1] != 20 || orders.timestamps[0] != timestamp.Unix()*1000 {
+		t.Errorf("Unexpected samples: %v at %v", orders.values, orders.timestamps)
+		t.Fail()
+	}
+}
+
+func TestRemoteWriteSinkDoesNotWaitForRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := DefaultRemoteWriteConfig
+	config.URL = server.URL
+	config.Retry = RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	sink := NewRemoteWriteSink(config)
+	sink.Write([]Datapoint{{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"topic": "orders"}, Value: 10, Timestamp: time.Now()}})
+
+	start := time.Now()
+	if sink.Flush() == nil {
+		t.Errorf("Expected the flush to fail")
+		t.Fail()
+	}
+	if elapsed := time.Since(start); requests != 2 || elapsed > 5*time.Second {
+		t.Errorf("Expected Retry-After to be capped at maxBackoff, got %d requests in %s", requests, elapsed)
+		t.Fail()
+	}
+}
+
+func TestRemoteWriteConfig(t *testing.T) {
+	config := DefaultRemoteWriteConfig
+	config.URL = "http://localhost:9090/api/v1/write"
+	config.Username = "user"
+	config.BearerToken = "token"
+	if checkSinks(SinksConfig{RemoteWrite: config}) == nil {
+		t.Errorf("Expected basic and bearer authentication to be mutually exclusive")
+		t.Fail()
+	}
+}
+
+func TestSinksRequirePollInterval(t *testing.T) {
+	context := ExporterContext{Granularity: "PT1M", Mode: "query", Retry: DefaultRetryPolicy, ScrapeTimeout: 60, Sinks: SinksConfig{RemoteWrite: DefaultRemoteWriteConfig}}
+	context.Sinks.RemoteWrite.URL = "http://localhost:9090/api/v1/write"
+	if checkConfiguration(&context) == nil {
+		t.Errorf("Expected the sinks to require config.pollInterval")
+		t.Fail()
+	}
+
+	context.PollInterval = 60
+	if err := checkConfiguration(&context); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+	}
+}
+
+func TestConfigurationStringRedactsSecrets(t *testing.T) {
+	context := ExporterContext{Sinks: SinksConfig{RemoteWrite: DefaultRemoteWriteConfig, InfluxDB: DefaultInfluxDBConfig, Splunk: DefaultSplunkHECConfig}, Pushgateway: DefaultPushgatewayConfig}
+	context.Sinks.RemoteWrite.Password = "remote-write-password"
+	context.Sinks.RemoteWrite.BearerToken = "remote-write-token"
+	context.Sinks.InfluxDB.Token = "influxdb-token"
+	context.Sinks.Splunk.Token = "splunk-token"
+	context.Pushgateway.Password = "pushgateway-password"
+	context.Pushgateway.Username = "pushgateway-user"
+
+	logged := fmt.Sprintf("%+v", context)
+	for _, secret := range []string{"remote-write-password", "remote-write-token", "influxdb-token", "splunk-token", "pushgateway-password"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("The logged configuration contains %s: %s", secret, logged)
+			t.Fail()
+		}
+	}
+	if !strings.Contains(logged, "pushgateway-user") {
+		t.Errorf("Expected the other options to be logged: %s", logged)
+		t.Fail()
+	}
+}
@@ -0,0 +1,129 @@
+package collector
+
+//
+// retry.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryPolicy defines how requests to the Metrics API are retried
+// when the API is throttling (429) or unavailable (5xx)
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+}
+
+// SendWithRetry sends the request created by newRequest and retries it, according to
+// Context.Retry, as long as the response is retryable and the deadline of ctx is not reached.
+// newRequest is invoked for every attempt as a request body can only be consumed once.
+// The body of the last response is fully read and returned, the response body is always closed.
+func SendWithRetry(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, []byte, error) {
+	return sendWithRetry(ctx, &httpClient, Context.Retry, limiter, newRequest)
+}
+
+// sendWithRetry is SendWithRetry with the client, the retry policy and the limiter of the destination
+// The limiter bounds the requests, nil to send them without limit, as the rate limit is only enforced by the Metrics API
+// Retries are counted in ccloud_metrics_api_retries_total for the requests sent to Confluent Cloud with the shared client
+func sendWithRetry(ctx context.Context, client *http.Client, policy RetryPolicy, rl *RequestLimiter, newRequest func() (*http.Request, error)) (*http.Response, []byte, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		res, body, err := doLimited(rl, client, req.WithContext(ctx))
+		if attempt >= policy.MaxAttempts || !isRetryable(res, err) {
+			return res, body, err
+		}
+
+		wait := policy.backoff(attempt, res)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			log.WithFields(log.Fields{"attempt": attempt, "backoff": wait, "host": req.URL.Host}).Warnln("Not retrying the request as the backoff would exceed the deadline")
+			return res, body, err
+		}
+
+		reason := "error"
+		if res != nil {
+			reason = strconv.Itoa(res.StatusCode)
+		}
+		if client == &httpClient {
+			retries.WithLabelValues(reason).Inc()
+		}
+		log.WithFields(log.Fields{"attempt": attempt, "backoff": wait, "reason": reason, "host": req.URL.Host}).Debugln("Retrying request")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return res, body, err
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryable returns true if the request failed for a transient reason
+func isRetryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// backoff returns how long to wait before the next attempt, at most MaxBackoff
+// The Retry-After and rateLimit-reset headers take precedence over the exponential backoff
+func (policy RetryPolicy) backoff(attempt int, res *http.Response) time.Duration {
+	if wait, ok := waitFromHeaders(res); ok {
+		if wait > policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+		return wait
+	}
+
+	backoff := float64(policy.BaseBackoff) * math.Pow(2, float64(attempt-1))
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	backoff -= backoff * policy.Jitter * rand.Float64()
+	return time.Duration(backoff)
+}
+
+func waitFromHeaders(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+
+	if retryAfter := res.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			wait := time.Until(date)
+			if wait < 0 {
+				wait = 0
+			}
+			return wait, true
+		}
+	}
+
+	if reset := res.Header.Get("rateLimit-reset"); reset != "" {
+		if seconds, err := strconv.Atoi(reset); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,135 @@
+package collector
+
+//
+// retry_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendWithRetryRetriesOnServerError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	Context = ExporterContext{Retry: RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+
+	res, _, err := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to succeed after retries, got %v (%v)", res, err)
+		t.Fail()
+		return
+	}
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+		t.Fail()
+	}
+}
+
+func TestSendWithRetryDoesNotRetryClientError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	Context = ExporterContext{Retry: RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}
+
+	res, _, _ := SendWithRetry(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if res.StatusCode != http.StatusBadRequest || attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+		t.Fail()
+	}
+}
+
+func TestSendWithRetryStopsAtDeadline(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	Context = ExporterContext{Retry: RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Minute}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, _, _ := SendWithRetry(ctx, func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if res.StatusCode != http.StatusTooManyRequests || attempts != 1 {
+		t.Errorf("Expected the Retry-After header to exceed the deadline, got %d attempts", attempts)
+		t.Fail()
+	}
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseBackoff: time.Second, MaxBackoff: time.Second * 5, Jitter: 0.5}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		backoff := policy.backoff(attempt, nil)
+		if backoff > policy.MaxBackoff || backoff <= 0 {
+			t.Errorf("Unexpected backoff %s for attempt %d", backoff, attempt)
+			t.Fail()
+		}
+	}
+}
+
+func TestBackoffFromHeadersIsBounded(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Second, MaxBackoff: time.Second * 30}
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Set("Retry-After", "3600")
+	if backoff := policy.backoff(1, res); backoff != policy.MaxBackoff {
+		t.Errorf("Expected Retry-After to be capped at %s, got %s", policy.MaxBackoff, backoff)
+		t.Fail()
+	}
+
+	res.Header.Set("Retry-After", "10")
+	if backoff := policy.backoff(1, res); backoff != 10*time.Second {
+		t.Errorf("Expected Retry-After to be honored, got %s", backoff)
+		t.Fail()
+	}
+}
+
+func TestRetryPolicyIsValidated(t *testing.T) {
+	if err := checkRetryPolicy(DefaultRetryPolicy, "config.http.retry"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+	}
+
+	policy := DefaultRetryPolicy
+	policy.BaseBackoff = 0
+	if checkRetryPolicy(policy, "config.http.retry") == nil {
+		t.Errorf("Expected a zero baseBackoff to be rejected")
+		t.Fail()
+	}
+
+	policy = DefaultRetryPolicy
+	policy.MaxBackoff = policy.BaseBackoff / 2
+	if checkRetryPolicy(policy, "config.http.retry") == nil {
+		t.Errorf("Expected a maxBackoff lower than baseBackoff to be rejected")
+		t.Fail()
+	}
+}
@@ -0,0 +1,71 @@
+package collector
+
+//
+// rule_errors.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RuleErrors gathers the errors of each rule during a single collection
+// It is attached to the context of the collection, thus concurrent collections do not share their errors
+type RuleErrors struct {
+	mutex  sync.Mutex
+	errors map[int][]string
+}
+
+// ruleErrorsKey is the key of the errors of a collection in its context
+type ruleErrorsKey struct{}
+
+// NewRuleErrors returns an empty set of errors
+func NewRuleErrors() *RuleErrors {
+	return &RuleErrors{errors: make(map[int][]string)}
+}
+
+// withRuleErrors returns a context where the errors of the collectors are recorded in errs
+func withRuleErrors(ctx context.Context, errs *RuleErrors) context.Context {
+	return context.WithValue(ctx, ruleErrorsKey{}, errs)
+}
+
+// reportRuleError records the error of a rule in the errors of the collection, if they are recorded
+func reportRuleError(ctx context.Context, rule Rule, err error) {
+	errs, present := ctx.Value(ruleErrorsKey{}).(*RuleErrors)
+	if present {
+		errs.Add(rule.id, err)
+	}
+}
+
+// Add records an error of a rule
+func (errs *RuleErrors) Add(ruleID int, err error) {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	errs.errors[ruleID] = append(errs.errors[ruleID], err.Error())
+}
+
+// Err returns an error listing the errors of each rule, nil if no error has been recorded
+func (errs *RuleErrors) Err() error {
+	errs.mutex.Lock()
+	defer errs.mutex.Unlock()
+	if len(errs.errors) == 0 {
+		return nil
+	}
+
+	ruleIDs := make([]int, 0, len(errs.errors))
+	for ruleID := range errs.errors {
+		ruleIDs = append(ruleIDs, ruleID)
+	}
+	sort.Ints(ruleIDs)
+	messages := make([]string, 0, len(ruleIDs))
+	for _, ruleID := range ruleIDs {
+		messages = append(messages, fmt.Sprintf("rule %d: %s", ruleID, strings.Join(errs.errors[ruleID], ", ")))
+	}
+	return fmt.Errorf("%d rules did not succeed (%s)", len(ruleIDs), strings.Join(messages, "; "))
+}
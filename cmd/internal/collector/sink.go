@@ -0,0 +1,284 @@
+package collector
+
+//
+// sink.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Datapoint is a data point collected from the Metrics API, as sent to the sinks
+type Datapoint struct {
+	// Name is the name of the Prometheus metric, e.g. ccloud_metric_received_bytes
+	Name string
+	// Metric is the description of the metric by the Metrics API
+	Metric MetricDescription
+	// Labels are all labels of the data point, as exposed to Prometheus
+	Labels map[string]string
+	// Resource identifies the resource of the data point, by key in the Metrics API, e.g. kafka.id
+	Resource map[string]string
+	// Attributes are the labels of the metric, i.e. all labels except the ones identifying the resource
+	Attributes map[string]string
+	Value      float64
+	Timestamp  time.Time
+	Rule       int
+}
+
+// Sink receives the data points collected from the Metrics API and pushes them to another system,
+// for environments that can not be scraped by Prometheus
+// Sinks are invoked concurrently by the collectors
+type Sink interface {
+	// Name identifies the sink in the logs and the metrics of the exporter
+	Name() string
+	// Write buffers data points, they are pushed when the sink is flushed
+	Write(points []Datapoint)
+	// Flush pushes the buffered data points, it is invoked after each collection
+	Flush() error
+}
+
+// sinkBuffer buffers the data points of a sink until it is flushed
+type sinkBuffer struct {
+	mutex  sync.Mutex
+	points []Datapoint
+	// sendMutex keeps the batches in order, as some systems reject out of order samples
+	sendMutex sync.Mutex
+}
+
+// Write buffers data points, they are pushed when the sink is flushed
+func (buffer *sinkBuffer) Write(points []Datapoint) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.points = append(buffer.points, points...)
+}
+
+// drain returns the buffered data points and empties the buffer
+func (buffer *sinkBuffer) drain() []Datapoint {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	points := buffer.points
+	buffer.points = nil
+	return points
+}
+
+// flush sends the buffered data points in batches of batchSize data points
+// A batch that can not be sent is dropped, the error of the last failed batch is returned
+func (buffer *sinkBuffer) flush(name string, batchSize int, send func(points []Datapoint) error) error {
+	points := buffer.drain()
+
+	buffer.sendMutex.Lock()
+	defer buffer.sendMutex.Unlock()
+	var lastErr error
+	for start := 0; start < len(points); start += batchSize {
+		end := start + batchSize
+		if end > len(points) {
+			end = len(points)
+		}
+
+		err := send(points[start:end])
+		if err != nil {
+			sinkPoints.WithLabelValues(name, "failed").Add(float64(end - start))
+			lastErr = err
+			continue
+		}
+		sinkPoints.WithLabelValues(name, "sent").Add(float64(end - start))
+	}
+	return lastErr
+}
+
+// seriesKey identifies the series of a data point by its name and labels
+// Keys are valid UTF-8, as they are persisted in JSON by the file sink
+func seriesKey(point Datapoint) string {
+	names := make([]string, 0, len(point.Labels))
+	for name := range point.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	builder.WriteString(point.Name)
+	for _, name := range names {
+		builder.WriteString("\x00" + name + "\x00" + point.Labels[name])
+	}
+	return builder.String()
+}
+
+// SinksConfig configures the sinks, a sink is enabled once its destination is configured
+type SinksConfig struct {
+	RemoteWrite RemoteWriteConfig
+	OTLP        OTLPConfig
+	DogStatsD   DogStatsDConfig
+	InfluxDB    InfluxDBConfig
+	Graphite    GraphiteConfig
+	Splunk      SplunkHECConfig
+	File        FileConfig
+}
+
+// SinkDispatcher forwards the data points of the collections to all sinks
+type SinkDispatcher struct {
+	mutex sync.RWMutex
+	sinks []Sink
+	// flushes holds the pending flush request of the flush loop
+	flushes chan struct{}
+}
+
+// dispatcher is the dispatcher shared by all collectors
+var dispatcher = NewSinkDispatcher()
+
+// NewSinkDispatcher returns a dispatcher forwarding data points to the given sinks
+func NewSinkDispatcher(sinks ...Sink) *SinkDispatcher {
+	return &SinkDispatcher{sinks: sinks, flushes: make(chan struct{}, 1)}
+}
+
+// SetSinks replaces the sinks data points are forwarded to
+func (dispatcher *SinkDispatcher) SetSinks(sinks []Sink) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	dispatcher.sinks = sinks
+}
+
+// Enabled returns true if at least one sink is configured
+func (dispatcher *SinkDispatcher) Enabled() bool {
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	return len(dispatcher.sinks) > 0
+}
+
+// Write forwards data points to all sinks
+func (dispatcher *SinkDispatcher) Write(points []Datapoint) {
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	for _, sink := range dispatcher.sinks {
+		sink.Write(points)
+	}
+}
+
+// Flush flushes all sinks, a failing sink does not prevent the others from being flushed
+func (dispatcher *SinkDispatcher) Flush() {
+	dispatcher.mutex.RLock()
+	defer dispatcher.mutex.RUnlock()
+	for _, sink := range dispatcher.sinks {
+		err := sink.Flush()
+		if err != nil {
+			log.WithError(err).WithField("sink", sink.Name()).Errorln("Can not push the data points to the sink")
+		}
+	}
+}
+
+// RequestFlush asks the flush loop to flush all sinks, without waiting for the flush
+// A request made while another one is pending is merged with it
+func (dispatcher *SinkDispatcher) RequestFlush() {
+	select {
+	case dispatcher.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// FlushLoop flushes all sinks whenever it is requested, thus slow sinks never delay the collection
+func (dispatcher *SinkDispatcher) FlushLoop() {
+	for range dispatcher.flushes {
+		dispatcher.Flush()
+	}
+}
+
+// configured returns true if at least one sink is enabled
+func (config SinksConfig) configured() bool {
+	return config.RemoteWrite.URL != "" || config.OTLP.URL != "" || config.DogStatsD.Address != "" || config.InfluxDB.URL != "" ||
+		config.Graphite.Address != "" || config.Splunk.URL != "" || config.File.Path != ""
+}
+
+// checkSinks returns an error describing the first invalid option of the sinks
+func checkSinks(config SinksConfig) error {
+	if config.RemoteWrite.URL != "" {
+		if err := config.RemoteWrite.check(); err != nil {
+			return err
+		}
+	}
+	if config.OTLP.URL != "" {
+		if err := config.OTLP.check(); err != nil {
+			return err
+		}
+	}
+	if config.DogStatsD.Address != "" {
+		if err := config.DogStatsD.check(); err != nil {
+			return err
+		}
+	}
+	if config.InfluxDB.URL != "" {
+		if err := config.InfluxDB.check(); err != nil {
+			return err
+		}
+	}
+	if config.Graphite.Address != "" {
+		if err := config.Graphite.check(); err != nil {
+			return err
+		}
+	}
+	if config.Splunk.URL != "" {
+		if err := config.Splunk.check(); err != nil {
+			return err
+		}
+	}
+	if config.File.Path != "" {
+		if err := config.File.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newConfiguredSinks creates the sinks enabled in the configuration
+func newConfiguredSinks() []Sink {
+	sinks := make([]Sink, 0)
+	if Context.Sinks.RemoteWrite.URL != "" {
+		sinks = append(sinks, NewRemoteWriteSink(Context.Sinks.RemoteWrite))
+	}
+	if Context.Sinks.OTLP.URL != "" {
+		sinks = append(sinks, NewOTLPSink(Context.Sinks.OTLP))
+	}
+	if Context.Sinks.DogStatsD.Address != "" {
+		sinks = append(sinks, NewDogStatsDSink(Context.Sinks.DogStatsD))
+	}
+	if Context.Sinks.InfluxDB.URL != "" {
+		sinks = append(sinks, NewInfluxDBSink(Context.Sinks.InfluxDB))
+	}
+	if Context.Sinks.Graphite.Address != "" {
+		sinks = append(sinks, NewGraphiteSink(Context.Sinks.Graphite))
+	}
+	if Context.Sinks.Splunk.URL != "" {
+		sinks = append(sinks, NewSplunkHECSink(Context.Sinks.Splunk))
+	}
+	if Context.Sinks.File.Path != "" {
+		sinks = append(sinks, NewFileSink(Context.Sinks.File))
+	}
+	return sinks
+}
+
+// redact hides a secret of the configuration, an empty secret is kept to show it is not configured
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// sendToSink sends the request created by newRequest with the client of a sink, and retries it according to the policy
+// Every attempt is bounded by the timeout of the client, and the retries by a deadline covering all attempts and
+// their backoffs, thus an unavailable sink does not block the flushes of the other sinks indefinitely.
+// Unlike SendWithRetry, requests are not limited as they are not sent to the Metrics API.
+func sendToSink(client *http.Client, policy RetryPolicy, newRequest func() (*http.Request, error)) (*http.Response, []byte, error) {
+	attempts := time.Duration(policy.MaxAttempts)
+	ctx, cancel := context.WithTimeout(context.Background(), attempts*client.Timeout+(attempts-1)*policy.MaxBackoff)
+	defer cancel()
+	return sendWithRetry(ctx, client, policy, nil, newRequest)
+}
@@ -0,0 +1,287 @@
+package collector
+
+//
+// splunk.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SplunkHECConfig configures the Splunk HTTP Event Collector sink
+type SplunkHECConfig struct {
+	URL                string
+	Token              string
+	Index              string
+	Source             string
+	Sourcetype         string
+	Host               string
+	BatchSize          int
+	Timeout            int
+	Retry              RetryPolicy
+	CAFile             string
+	InsecureSkipVerify bool
+	// Ack waits for the events to be indexed, indexer acknowledgment must be enabled on the token
+	Ack        bool
+	AckTimeout int
+	Channel    string
+}
+
+// DefaultSplunkHECConfig is the default configuration of the Splunk HEC sink
+var DefaultSplunkHECConfig = SplunkHECConfig{
+	Source:     "ccloudexporter",
+	BatchSize:  500,
+	Timeout:    30,
+	Retry:      DefaultRetryPolicy,
+	AckTimeout: 60,
+}
+
+// String returns the configuration with the token redacted, as it is logged on startup
+func (config SplunkHECConfig) String() string {
+	type plain SplunkHECConfig
+	config.Token = redact(config.Token)
+	return fmt.Sprintf("%+v", plain(config))
+}
+
+// splunkAckPollInterval is the interval between two polls of the acknowledgment of a batch
+var splunkAckPollInterval = time.Second
+
+// SplunkHECSink posts the data points as metric events to a Splunk HTTP Event Collector
+// Data points sharing the same labels and timestamp are posted as a single multiple-metric event
+type SplunkHECSink struct {
+	config SplunkHECConfig
+	client http.Client
+	sinkBuffer
+}
+
+// splunkEvent is a metric event of the HTTP Event Collector,
+// the fields hold the dimensions and a metric_name:<name> field per metric
+type splunkEvent struct {
+	Time       float64                `json:"time"`
+	Event      string                 `json:"event"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	Sourcetype string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+type splunkAckRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type splunkAckResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+// check returns an error describing the first invalid option of the Splunk HEC sink
+func (config SplunkHECConfig) check() error {
+	if _, err := url.ParseRequestURI(config.URL); err != nil {
+		return fmt.Errorf("config.sinks.splunk.url is not a valid URL: %s", err)
+	}
+
+	if config.Token == "" {
+		return errors.New("config.sinks.splunk.token is required")
+	}
+
+	if config.BatchSize <= 0 || config.Timeout <= 0 || config.AckTimeout <= 0 {
+		return errors.New("config.sinks.splunk.batchSize, config.sinks.splunk.timeout and config.sinks.splunk.ackTimeout must be positive")
+	}
+
+	if _, err := config.tlsConfig(); err != nil {
+		return err
+	}
+
+	return checkRetryPolicy(config.Retry, "config.sinks.splunk.retry")
+}
+
+// tlsConfig returns the TLS configuration used to connect to the HTTP Event Collector
+func (config SplunkHECConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read config.sinks.splunk.caFile: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("config.sinks.splunk.caFile %s does not contain any PEM certificate", config.CAFile)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// NewSplunkHECSink creates a new Splunk HEC sink
+func NewSplunkHECSink(config SplunkHECConfig) *SplunkHECSink {
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		log.WithError(err).Fatalln("Invalid TLS configuration for the Splunk HEC sink")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if config.Ack && config.Channel == "" {
+		config.Channel = newChannelID()
+	}
+	return &SplunkHECSink{
+		config: config,
+		client: http.Client{Timeout: time.Second * time.Duration(config.Timeout), Transport: transport},
+	}
+}
+
+// Name identifies the sink in the logs and the metrics of the exporter
+func (sink *SplunkHECSink) Name() string {
+	return "splunk"
+}
+
+// Flush posts the buffered data points, in batches of at most config.sinks.splunk.batchSize data points
+// A batch that can not be posted after all retries, or that is not acknowledged, is dropped
+func (sink *SplunkHECSink) Flush() error {
+	return sink.flush(sink.Name(), sink.config.BatchSize, sink.send)
+}
+
+// send posts a single batch of events and waits for its acknowledgment if enabled
+func (sink *SplunkHECSink) send(points []Datapoint) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range sink.newEvents(points) {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	endpoint := strings.TrimSuffix(sink.config.URL, "/") + "/services/collector"
+	res, resBody, err := sendToSink(&sink.client, sink.config.Retry, func() (*http.Request, error) {
+		return sink.newRequest(endpoint, body.Bytes())
+	})
+	if err != nil {
+		return fmt.Errorf("Splunk HEC request to %s failed: %s", sink.config.URL, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("received status code %d from %s (%s)", res.StatusCode, sink.config.URL, resBody)
+	}
+
+	if sink.config.Ack {
+		response := splunkResponse{}
+		if err := json.Unmarshal(resBody, &response); err != nil || response.AckID == nil {
+			return fmt.Errorf("no acknowledgment ID received from %s, indexer acknowledgment must be enabled on the token (%s)", sink.config.URL, resBody)
+		}
+		if err := sink.waitForAck(*response.AckID); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{"dataPoints": len(points), "url": sink.config.URL}).Debugln("Data points have been posted to Splunk")
+	return nil
+}
+
+// waitForAck polls the acknowledgment endpoint until the events of ackID have been indexed
+func (sink *SplunkHECSink) waitForAck(ackID int64) error {
+	endpoint := strings.TrimSuffix(sink.config.URL, "/") + "/services/collector/ack?" + url.Values{"channel": {sink.config.Channel}}.Encode()
+	body, _ := json.Marshal(splunkAckRequest{Acks: []int64{ackID}})
+	deadline := time.Now().Add(time.Second * time.Duration(sink.config.AckTimeout))
+	for {
+		res, resBody, err := sendToSink(&sink.client, sink.config.Retry, func() (*http.Request, error) {
+			return sink.newRequest(endpoint, body)
+		})
+		if err == nil && res.StatusCode/100 == 2 {
+			response := splunkAckResponse{}
+			if json.Unmarshal(resBody, &response) == nil && response.Acks[strconv.FormatInt(ackID, 10)] {
+				return nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("events have not been acknowledged by %s after %d seconds", sink.config.URL, sink.config.AckTimeout)
+		}
+		time.Sleep(splunkAckPollInterval)
+	}
+}
+
+func (sink *SplunkHECSink) newRequest(endpoint string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+sink.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ccloudexporter/"+Version)
+	if sink.config.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", sink.config.Channel)
+	}
+	return req, nil
+}
+
+// newEvents groups the data points sharing the same labels and timestamp in metric events
+func (sink *SplunkHECSink) newEvents(points []Datapoint) []*splunkEvent {
+	events := make([]*splunkEvent, 0)
+	eventsByKey := make(map[string]*splunkEvent)
+	for _, point := range points {
+		timestamp := point.Timestamp
+		if timestamp.IsZero() {
+			timestamp = time.Now()
+		}
+
+		names := make([]string, 0, len(point.Labels))
+		for name := range point.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		key := strconv.FormatInt(timestamp.Unix(), 10)
+		for _, name := range names {
+			key += "\xff" + name + "\xff" + point.Labels[name]
+		}
+
+		event, present := eventsByKey[key]
+		if !present {
+			event = &splunkEvent{
+				Time:       float64(timestamp.UnixNano()/int64(time.Millisecond)) / 1000,
+				Event:      "metric",
+				Host:       sink.config.Host,
+				Source:     sink.config.Source,
+				Sourcetype: sink.config.Sourcetype,
+				Index:      sink.config.Index,
+				Fields:     make(map[string]interface{}),
+			}
+			for name, value := range point.Labels {
+				event.Fields[name] = value
+			}
+			eventsByKey[key] = event
+			events = append(events, event)
+		}
+		event.Fields["metric_name:"+point.Name] = point.Value
+	}
+	return events
+}
+
+// newChannelID returns a random UUID identifying the channel of the acknowledgments
+func newChannelID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
@@ -0,0 +1,103 @@
+package collector
+
+//
+// splunk_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSplunkHECSink(t *testing.T) {
+	splunkAckPollInterval = time.Millisecond
+	var mutex sync.Mutex
+	events := make([]map[string]interface{}, 0)
+	ackPolls := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Header.Get("Authorization") != "Splunk secret" || r.Header.Get("X-Splunk-Request-Channel") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/services/collector":
+			decoder := json.NewDecoder(r.Body)
+			for decoder.More() {
+				event := make(map[string]interface{})
+				decoder.Decode(&event)
+				events = append(events, event)
+			}
+			w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case "/services/collector/ack":
+			// The events are indexed on the second poll
+			ackPolls++
+			if ackPolls == 1 {
+				w.Write([]byte(`{"acks":{"7":false}}`))
+				return
+			}
+			w.Write([]byte(`{"acks":{"7":true}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := DefaultSplunkHECConfig
+	config.URL = server.URL
+	config.Token = "secret"
+	config.Index = "metrics"
+	config.InsecureSkipVerify = true
+	config.Ack = true
+	sink := NewSplunkHECSink(config)
+
+	timestamp := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	labels := map[string]string{"kafka_id": "lkc-1", "topic": "orders"}
+	sink.Write([]Datapoint{
+		{Name: "ccloud_metric_received_bytes", Labels: labels, Value: 10, Timestamp: timestamp},
+		{Name: "ccloud_metric_sent_bytes", Labels: labels, Value: 20, Timestamp: timestamp},
+		{Name: "ccloud_metric_received_bytes", Labels: map[string]string{"kafka_id": "lkc-1", "topic": "payments"}, Value: 5, Timestamp: timestamp},
+	})
+	err := sink.Flush()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if len(events) != 2 || ackPolls != 2 {
+		t.Errorf("Expected 2 events acknowledged after 2 polls, got %d events and %d polls", len(events), ackPolls)
+		t.Fail()
+		return
+	}
+	event := events[0]
+	fields := event["fields"].(map[string]interface{})
+	if event["event"] != "metric" || event["index"] != "metrics" || event["time"] != float64(1609459200) {
+		t.Errorf("Unexpected event: %v", event)
+		t.Fail()
+	}
+	if fields["metric_name:ccloud_metric_received_bytes"] != float64(10) || fields["metric_name:ccloud_metric_sent_bytes"] != float64(20) || fields["topic"] != "orders" {
+		t.Errorf("Expected a multiple-metric event, got %v", fields)
+		t.Fail()
+	}
+}
+
+func TestSplunkHECConfig(t *testing.T) {
+	config := DefaultSplunkHECConfig
+	config.URL = "https://localhost:8088"
+	config.Token = "secret"
+	config.CAFile = "/nonexistent/ca.pem"
+	if checkSinks(SinksConfig{Splunk: config}) == nil {
+		t.Errorf("Expected an unreadable CA file to be rejected")
+		t.Fail()
+	}
+}
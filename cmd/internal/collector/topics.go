@@ -0,0 +1,203 @@
+package collector
+
+//
+// topics.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// topicListingMetric is the metric queried to list the topics of a cluster
+var topicListingMetric = MetricDescription{
+	Name:   "io.confluent.kafka.server/retained_bytes",
+	Labels: []MetricLabel{{Key: "topic"}},
+}
+
+var (
+	// resolvedTopics are the topics matching the patterns of each rule, by rule id
+	resolvedTopics      = make(map[int][]string)
+	resolvedTopicsMutex sync.RWMutex
+
+	compiledTopicPatterns      = make(map[string]topicPattern)
+	compiledTopicPatternsMutex sync.Mutex
+)
+
+// topicPattern is either a regular expression or a glob
+type topicPattern struct {
+	regexp *regexp.Regexp
+	glob   string
+}
+
+// Match returns true if the topic matches the pattern
+func (pattern topicPattern) Match(topic string) bool {
+	if pattern.regexp != nil {
+		return pattern.regexp.MatchString(topic)
+	}
+	matched, _ := path.Match(pattern.glob, topic)
+	return matched
+}
+
+// compileTopicPattern parses a topic pattern
+// Patterns enclosed in slashes, e.g. /^orders-.*/, are regular expressions, others are globs, e.g. orders-*
+func compileTopicPattern(pattern string) (topicPattern, error) {
+	compiledTopicPatternsMutex.Lock()
+	defer compiledTopicPatternsMutex.Unlock()
+	compiled, present := compiledTopicPatterns[pattern]
+	if present {
+		return compiled, nil
+	}
+
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expression, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return compiled, fmt.Errorf("invalid topic pattern %s: %s", pattern, err)
+		}
+		compiled = topicPattern{regexp: expression}
+	} else {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return compiled, fmt.Errorf("invalid topic pattern %s: %s", pattern, err)
+		}
+		compiled = topicPattern{glob: pattern}
+	}
+	compiledTopicPatterns[pattern] = compiled
+	return compiled, nil
+}
+
+func matchesAnyTopicPattern(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		compiled, err := compileTopicPattern(pattern)
+		if err == nil && compiled.Match(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTopicPatterns returns an error if one of the topic patterns of the rule is invalid
+func (rule Rule) checkTopicPatterns() error {
+	for _, pattern := range append(append([]string{}, rule.TopicPatterns...), rule.ExcludeTopics...) {
+		_, err := compileTopicPattern(pattern)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selectsTopics returns true if the rule only targets some topics, by name or by pattern
+func (rule Rule) selectsTopics() bool {
+	return len(rule.Topics) > 0 || len(rule.TopicPatterns) > 0
+}
+
+// hasTopicPatterns returns true if the topics of the rule need to be resolved
+func (rule Rule) hasTopicPatterns() bool {
+	return len(rule.TopicPatterns) > 0 || len(rule.ExcludeTopics) > 0
+}
+
+// MatchesTopic returns true if the topic is targeted by the rule
+func (rule Rule) MatchesTopic(topic string) bool {
+	if matchesAnyTopicPattern(rule.ExcludeTopics, topic) {
+		return false
+	}
+	if !rule.selectsTopics() {
+		return true
+	}
+	return contains(rule.Topics, topic) || matchesAnyTopicPattern(rule.TopicPatterns, topic)
+}
+
+// GetTopics returns the topics used to filter the queries of the rule
+// For rules with patterns, the topics are the resolved ones, and false is returned
+// if no topic matches or the patterns have not been resolved yet, as the rule should not be queried
+func (rule Rule) GetTopics() ([]string, bool) {
+	if !rule.hasTopicPatterns() {
+		return rule.Topics, true
+	}
+
+	resolvedTopicsMutex.RLock()
+	defer resolvedTopicsMutex.RUnlock()
+	topics := resolvedTopics[rule.id]
+	return topics, len(topics) > 0
+}
+
+// ResolveTopics lists the topics of the clusters of the rule and returns the ones targeted by the rule
+func ResolveTopics(ctx context.Context, rule Rule) ([]string, error) {
+	resource := ResourceDescription{Type: "kafka", Labels: []MetricLabel{{Key: "kafka.id"}}}
+	query := BuildQuery(topicListingMetric, rule.Clusters, []string{"topic"}, nil, resource)
+	response, err := SendQuery(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]string, 0)
+	for _, dataPoint := range response.Data {
+		topic, present := dataPoint["metric.topic"].(string)
+		if present && rule.MatchesTopic(topic) && !contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	// Topics listed by name are kept, even if they do not have any data point yet
+	for _, topic := range rule.Topics {
+		if rule.MatchesTopic(topic) && !contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// refreshResolvedTopics resolves the topics of all rules with topic patterns
+// If the topics of a rule can not be resolved, the previously resolved topics are kept
+func refreshResolvedTopics() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(Context.ScrapeTimeout))
+	defer cancel()
+
+	resolved := make(map[int][]string)
+	for _, rule := range Context.GetKafkaRules() {
+		if !rule.hasTopicPatterns() {
+			continue
+		}
+
+		topics, err := ResolveTopics(ctx, rule)
+		if err != nil {
+			log.WithError(err).WithField("rule", rule.id).Errorln("Can not resolve the topic patterns, previously resolved topics are kept")
+			resolvedTopicsMutex.RLock()
+			topics = resolvedTopics[rule.id]
+			resolvedTopicsMutex.RUnlock()
+		} else {
+			log.WithFields(log.Fields{"rule": rule.id, "topics": len(topics)}).Debugln("Topic patterns have been resolved")
+		}
+		resolved[rule.id] = topics
+	}
+
+	resolvedTopicsMutex.Lock()
+	resolvedTopics = resolved
+	resolvedTopicsMutex.Unlock()
+}
+
+// refreshTopics periodically resolves the topic patterns, so new topics are collected
+func refreshTopics() {
+	refreshResolvedTopics()
+	if Context.TopicRefreshInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(Context.TopicRefreshInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshResolvedTopics()
+	}
+}
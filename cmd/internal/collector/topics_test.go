@@ -0,0 +1,105 @@
+package collector
+
+//
+// topics_test.go
+// Copyright (C) 2021 gaspar_d </var/spool/mail/gaspar_d>
+//
+// Distributed under terms of the MIT license.
+//
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMatchesTopic(t *testing.T) {
+	rule := Rule{
+		Topics:        []string{"payments"},
+		TopicPatterns: []string{"orders-*", "/^invoices-[0-9]+$/"},
+		ExcludeTopics: []string{"orders-internal"},
+	}
+
+	expectations := map[string]bool{
+		"payments":        true,
+		"orders-eu":       true,
+		"orders-internal": false,
+		"invoices-42":     true,
+		"invoices-eu":     false,
+		"shipments":       false,
+	}
+	for topic, expected := range expectations {
+		if rule.MatchesTopic(topic) != expected {
+			t.Errorf("Expected MatchesTopic(%s) to be %t", topic, expected)
+			t.Fail()
+		}
+	}
+
+	excludeOnly := Rule{ExcludeTopics: []string{"_confluent-*"}}
+	if !excludeOnly.MatchesTopic("orders") || excludeOnly.MatchesTopic("_confluent-metrics") {
+		t.Errorf("Rules with only excluded topics should match every other topic")
+		t.Fail()
+	}
+}
+
+func TestInvalidTopicPattern(t *testing.T) {
+	rule := Rule{TopicPatterns: []string{"/orders-(/"}}
+	if rule.checkTopicPatterns() == nil {
+		t.Errorf("Expected an invalid regular expression to be rejected")
+		t.Fail()
+	}
+
+	rule = Rule{ExcludeTopics: []string{"orders-["}}
+	if rule.checkTopicPatterns() == nil {
+		t.Errorf("Expected an invalid glob to be rejected")
+		t.Fail()
+	}
+}
+
+func TestResolveTopics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":[
+			{"timestamp":"2021-01-01T00:00:00Z","value":1.0,"metric.topic":"orders-eu"},
+			{"timestamp":"2021-01-01T00:00:00Z","value":1.0,"metric.topic":"_confluent-metrics"},
+			{"timestamp":"2021-01-01T00:00:00Z","value":1.0,"metric.topic":"payments"}
+		]}`)
+	}))
+	defer server.Close()
+
+	os.Setenv("CCLOUD_API_KEY", "key")
+	os.Setenv("CCLOUD_API_SECRET", "secret")
+	Context = ExporterContext{HTTPBaseURL: server.URL + "/", Retry: RetryPolicy{MaxAttempts: 1}, Granularity: "PT1M"}
+
+	rule := Rule{Clusters: []string{"lkc-1"}, ExcludeTopics: []string{"_confluent-*"}}
+	topics, err := ResolveTopics(context.Background(), rule)
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		t.Fail()
+		return
+	}
+
+	if !reflect.DeepEqual(topics, []string{"orders-eu", "payments"}) {
+		t.Errorf("Unexpected resolved topics: %s", topics)
+		t.Fail()
+	}
+}
+
+func TestShouldIgnoreResultForTopicPattern(t *testing.T) {
+	globalRule := Rule{id: 0, Clusters: []string{"lkc-1"}, Metrics: []string{"metric"}}
+	patternRule := Rule{id: 1, Clusters: []string{"lkc-1"}, Metrics: []string{"metric"}, TopicPatterns: []string{"orders-*"}}
+	Context = ExporterContext{Rules: []Rule{globalRule, patternRule}}
+
+	if !globalRule.ShouldIgnoreResultForRule("orders-eu", "lkc-1", "metric") {
+		t.Errorf("Topics matching the pattern of another rule should be ignored by the global rule")
+		t.Fail()
+	}
+
+	if globalRule.ShouldIgnoreResultForRule("payments", "lkc-1", "metric") {
+		t.Errorf("Topics not matching the pattern of another rule should not be ignored")
+		t.Fail()
+	}
+}